@@ -1,9 +1,13 @@
 package firetap_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"strings"
 	"sync"
 	"testing"
@@ -13,14 +17,17 @@ import (
 )
 
 type testLogSender struct {
-	logs []byte
-	mu   sync.Mutex
+	logs    []byte
+	records []firetap.Record
+	mu      sync.Mutex
 }
 
-func (s *testLogSender) Send(ctx context.Context, log []byte) error {
+func (s *testLogSender) Send(ctx context.Context, rec firetap.Record) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.logs = append(s.logs, log...)
+	s.logs = append(s.logs, rec.Data...)
+	rec.Data = bytes.Clone(rec.Data) // the caller reuses the data
+	s.records = append(s.records, rec)
 	return nil
 }
 
@@ -40,10 +47,19 @@ func (s *testLogSender) String() string {
 	return string(s.logs)
 }
 
+// stdoutLines returns the records of the stdout lines of the wrapper.
+func stdoutLines(lines ...string) string {
+	var b strings.Builder
+	for _, l := range lines {
+		fmt.Fprintf(&b, `{"stream":"stdout","message":%q}`+"\n", l)
+	}
+	return b.String()
+}
+
 func TestTelemetryAPI(t *testing.T) {
 	sender := &testLogSender{}
 	m := http.NewServeMux()
-	m.HandleFunc("/", firetap.HandleTelemetry(sender))
+	m.HandleFunc("/", firetap.HandleTelemetry(sender, false))
 	s := httptest.NewServer(m)
 	defer s.Close()
 
@@ -62,7 +78,335 @@ func TestTelemetryAPI(t *testing.T) {
 	}
 	time.Sleep(1000 * time.Millisecond)
 
-	if sender.String() != strings.Repeat("foo\nbar\nbaz\n", 5) {
+	if sender.String() != strings.Repeat(stdoutLines("foo", "bar", "baz"), 5) {
 		t.Errorf("unexpected logs: %s", sender.logs)
 	}
 }
+
+func TestTelemetryAPIStderr(t *testing.T) {
+	sender := &testLogSender{}
+	m := http.NewServeMux()
+	m.HandleFunc("/", firetap.HandleTelemetry(sender, true))
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := firetap.NewTelemetryAPIClient(s.URL)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+
+	passthrough := &strings.Builder{}
+	stderr := c.Stderr(passthrough)
+	c.Write([]byte("foo\n"))
+	stderr.Write([]byte("bar"))
+	stderr.Write([]byte("\n"))
+	c.Write([]byte(`{"baz":1}` + "\n"))
+	stderr.Write([]byte("incomplete"))
+	cancel()
+	<-done
+
+	expected := `{"stream":"stdout","message":"foo"}
+{"stream":"stderr","message":"bar"}
+{"stream":"stdout","baz":1}
+{"stream":"stderr","message":"incomplete"}
+`
+	if sender.String() != expected {
+		t.Errorf("unexpected logs: %s", sender.String())
+	}
+	if passthrough.String() != "bar\nincomplete" {
+		t.Errorf("unexpected passthrough: %s", passthrough.String())
+	}
+}
+
+func TestWrapperOption(t *testing.T) {
+	t.Setenv("FIRETAP_STREAM_NAME", "test")
+	t.Setenv("FIRETAP_STDERR_PASSTHROUGH", "true")
+	t.Setenv("FIRETAP_BUFFER_MAX_EVENTS", "5")
+	t.Setenv("FIRETAP_DROP_POLICY", "drop_newest")
+	opt, err := firetap.NewWrapperOption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opt.StderrPassthrough || opt.RuntimeProxy || opt.BufferMaxEvents != 5 || opt.DropPolicy != "drop_newest" || opt.StreamName != "test" {
+		t.Errorf("unexpected options: %#v", opt)
+	}
+}
+
+func TestTelemetryAPIBrokenJSON(t *testing.T) {
+	sender := &testLogSender{}
+	m := http.NewServeMux()
+	m.HandleFunc("/", firetap.HandleTelemetry(sender, true))
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := firetap.NewTelemetryAPIClient(s.URL)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+	for _, line := range []string{"{broken line\n", `{"a":1} trailing` + "\n", `{"a":1}` + "\n"} {
+		c.Write([]byte(line))
+	}
+	cancel()
+	<-done
+
+	expected := `{"stream":"stdout","message":"{broken line"}
+{"stream":"stdout","message":"{\"a\":1} trailing"}
+{"stream":"stdout","a":1}
+`
+	if sender.String() != expected {
+		t.Errorf("unexpected logs: %s", sender.String())
+	}
+}
+
+func TestRuntimeAPIProxy(t *testing.T) {
+	sender := &testLogSender{}
+	m := http.NewServeMux()
+	m.HandleFunc("/", firetap.HandleTelemetry(sender, true))
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	runtime := http.NewServeMux()
+	runtime.HandleFunc("GET /2018-06-01/runtime/invocation/next", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Lambda-Runtime-Aws-Request-Id", "req-1")
+		w.Header().Set("Lambda-Runtime-Deadline-Ms", "1718000000000")
+		w.Write([]byte(`{}`))
+	})
+	runtime.HandleFunc("POST /2018-06-01/runtime/invocation/{id}/response", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	rs := httptest.NewServer(runtime)
+	defer rs.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := firetap.NewTelemetryAPIClient(s.URL)
+	go c.Run(ctx)
+	proxy, err := firetap.NewRuntimeAPIProxy(strings.TrimPrefix(rs.URL, "http://"), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run(ctx)
+
+	resp, err := http.Get("http://" + proxy.Addr + "/2018-06-01/runtime/invocation/next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Write([]byte("foo\n"))
+	resp, err = http.Post("http://"+proxy.Addr+"/2018-06-01/runtime/invocation/req-1/response", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	// flushed before the response is returned
+	if sender.String() != `{"stream":"stdout","requestId":"req-1","message":"foo"}`+"\n" {
+		t.Errorf("unexpected logs: %s", sender.String())
+	}
+}
+
+func TestStats(t *testing.T) {
+	sender := &testLogSender{}
+	r := &firetap.Receiver{}
+	s := httptest.NewServer(r.Handler(sender))
+	defer s.Close()
+
+	getStats := func() firetap.Stats {
+		t.Helper()
+		resp, err := http.Get(s.URL + "/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var stats firetap.Stats
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	before := getStats()
+	events := `[
+		{"time":"2024-06-15T00:00:00.000Z","type":"function","record":"foo"},
+		{"time":"2024-06-15T00:00:00.000Z","type":"function","record":{"bar":1}},
+		{"time":"2024-06-15T00:00:00.000Z","type":"platform.start","record":{"requestId":"x"}}
+	]`
+	resp, err := http.Post(s.URL+"/", "application/json", strings.NewReader(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	after := getStats()
+
+	if d := after.Metrics.Received - before.Metrics.Received; d != 3 {
+		t.Errorf("received = %d, want 3", d)
+	}
+	if d := after.Metrics.Sent - before.Metrics.Sent; d != 2 {
+		t.Errorf("sent = %d, want 2", d)
+	}
+	if d := after.Metrics.Ignored - before.Metrics.Ignored; d != 1 {
+		t.Errorf("ignored = %d, want 1", d)
+	}
+	if len(after.Sinks) != 0 {
+		t.Errorf("unexpected sink status: %v", after.Sinks)
+	}
+
+	resp, err = http.Get(s.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("healthz status = %d", resp.StatusCode)
+	}
+	resp, err = http.Get(s.URL + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("pprof must be disabled by default")
+	}
+}
+
+func TestTelemetryTimestamp(t *testing.T) {
+	sender := &testLogSender{}
+	r := &firetap.Receiver{TimestampField: "timestamp"}
+	s := httptest.NewServer(r.Handler(sender))
+	defer s.Close()
+
+	events := `[
+		{"time":"2024-06-15T00:00:00.123Z","type":"function","record":"foo"},
+		{"time":"2024-06-15T00:00:00.123456789Z","type":"function","record":{"bar":1}}
+	]`
+	resp, err := http.Post(s.URL+"/", "application/json", strings.NewReader(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	expected := `{"timestamp":"2024-06-15T00:00:00.123Z","message":"foo"}
+{"timestamp":"2024-06-15T00:00:00.123456789Z","bar":1}
+`
+	if sender.String() != expected {
+		t.Errorf("unexpected logs: %s", sender.String())
+	}
+	if len(sender.records) != 2 {
+		t.Fatalf("unexpected records: %d", len(sender.records))
+	}
+	want := time.Date(2024, 6, 15, 0, 0, 0, 123456789, time.UTC)
+	if got := sender.records[1].Time; !got.Equal(want) {
+		t.Errorf("unexpected time: %s", got)
+	}
+}
+
+func TestTelemetryRecordID(t *testing.T) {
+	sender := &testLogSender{}
+	r := &firetap.Receiver{IDField: "_meta"}
+	s := httptest.NewServer(r.Handler(sender))
+	defer s.Close()
+
+	events := `[
+		{"time":"2024-06-15T00:00:00.000Z","type":"function","record":"foo"},
+		{"time":"2024-06-15T00:00:00.001Z","type":"function","record":{"bar":1}},
+		{"time":"2024-06-15T00:00:00.002Z","type":"function","record":"baz","id":"01902112-4a80-7000-8000-000000000000","seq":42}
+	]`
+	resp, err := http.Post(s.URL+"/", "application/json", strings.NewReader(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	type meta struct {
+		ID      string `json:"id"`
+		Sandbox string `json:"sandbox"`
+		Seq     uint64 `json:"seq"`
+	}
+	var metas []meta
+	dec := json.NewDecoder(strings.NewReader(sender.String()))
+	for dec.More() {
+		var rec struct {
+			Meta meta `json:"_meta"`
+		}
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		metas = append(metas, rec.Meta)
+	}
+	if len(metas) != 3 {
+		t.Fatalf("unexpected records: %s", sender.String())
+	}
+	uuidv7 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for _, m := range metas[:2] {
+		if !uuidv7.MatchString(m.ID) || m.Sandbox == "" {
+			t.Errorf("unexpected meta: %#v", m)
+		}
+	}
+	if metas[0].ID >= metas[1].ID || metas[0].Seq+1 != metas[1].Seq {
+		t.Errorf("IDs and sequence numbers must increase: %#v", metas[:2])
+	}
+	if m := metas[2]; m.ID != "01902112-4a80-7000-8000-000000000000" || m.Seq != 42 || m.Sandbox != metas[0].Sandbox+"-wrapper" {
+		t.Errorf("the ID by the wrapper must be kept: %#v", m)
+	}
+}
+
+func TestTelemetryRecordSeqIncludesProcessorDrops(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "dummy")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "dummy")
+	t.Setenv("AWS_REGION", "us-east-1")
+	f := &fakeFirehose{}
+	fs := httptest.NewServer(f)
+	defer fs.Close()
+	cfg, err := firetap.LoadConfig(&firetap.Option{StreamName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Outputs[0].Endpoint = fs.URL
+	cfg.Processors = []firetap.ProcessorConfig{{Type: "filter", FilterConfig: firetap.FilterConfig{Exclude: "DEBUG"}}}
+	ctx := context.Background()
+	p, err := firetap.NewPipeline(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer((&firetap.Receiver{IDField: "_meta"}).Handler(p))
+	defer s.Close()
+	events := `[
+		{"time":"2024-06-15T00:00:00.000Z","type":"function","record":"INFO foo"},
+		{"time":"2024-06-15T00:00:00.001Z","type":"function","record":"DEBUG bar"},
+		{"time":"2024-06-15T00:00:00.002Z","type":"function","record":"INFO baz"}
+	]`
+	resp, err := http.Post(s.URL+"/", "application/json", strings.NewReader(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := p.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var seqs []uint64
+	for _, r := range f.recorded() {
+		var rec struct {
+			Meta struct {
+				Seq uint64 `json:"seq"`
+			} `json:"_meta"`
+		}
+		if err := json.Unmarshal([]byte(r), &rec); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, rec.Meta.Seq)
+	}
+	// seq is stamped before the processors, so a record dropped by them is a gap
+	if len(seqs) != 2 || seqs[1] != seqs[0]+2 {
+		t.Errorf("the filtered record must leave a gap: %v", seqs)
+	}
+}
@@ -0,0 +1,244 @@
+package firetap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	slogcontext "github.com/PumpkinSeed/slog-context"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// BenchOption represents the options of the bench command.
+type BenchOption struct {
+	Duration  time.Duration `help:"Duration of the benchmark" default:"10s"`
+	Rate      int           `help:"Telemetry events per second (0 means as fast as possible)" default:"0"`
+	BatchSize int           `help:"Events in a Telemetry API request" default:"100"`
+	LineSize  int           `help:"Bytes of a log line" default:"200"`
+	JSON      bool          `help:"Generate JSON object records instead of text records"`
+}
+
+// BenchResult is the result of the bench command.
+type BenchResult struct {
+	Duration    time.Duration
+	Requests    int
+	Events      int
+	Bytes       int
+	Latencies   []time.Duration
+	Mallocs     uint64
+	TotalAlloc  uint64
+	MaxHeap     uint64
+	FailedPosts int
+	APICalls    int64
+}
+
+// benchSink is an in-process stand-in of the Firehose and Kinesis APIs that accepts all the records.
+type benchSink struct {
+	calls atomic.Int64
+}
+
+func (s *benchSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	s.calls.Add(1)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch target := r.Header.Get("X-Amz-Target"); {
+	case strings.HasSuffix(target, ".PutRecordBatch"):
+		w.Write([]byte(`{"Encrypted":false,"FailedPutCount":0,"RequestResponses":[]}`))
+	case strings.HasSuffix(target, ".PutRecords"):
+		w.Write([]byte(`{"FailedRecordCount":0,"Records":[]}`))
+	default:
+		w.Header().Set("X-Amzn-ErrorType", "UnknownOperationException")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"UnknownOperationException","message":"unsupported by firetap bench"}`))
+	}
+}
+
+// Bench drives the receiver and the pipeline by synthetic telemetry, and reports the throughput,
+// the latency and the memory. The outputs encode the records and call the API of the fake sink in the process.
+func Bench(ctx context.Context, opt *Option) error {
+	return bench(ctx, opt, os.Stdout)
+}
+
+func bench(ctx context.Context, opt *Option, w io.Writer) error {
+	ctx = slogcontext.WithValue(ctx, "component", "bench")
+	if opt.Config == "" && opt.StreamName == "" {
+		opt.StreamName = "bench"
+	}
+	cfg, err := LoadConfig(opt)
+	if err != nil {
+		return err
+	}
+	rcv, err := NewReceiver(ctx, opt, cfg)
+	if err != nil {
+		return err
+	}
+
+	sink := &benchSink{}
+	ts := httptest.NewServer(sink)
+	defer ts.Close()
+	for i := range cfg.Outputs {
+		benchOutput(&cfg.Outputs[i], ts.URL)
+	}
+	if m := cfg.InvocationMetrics; m != nil {
+		if m.Output != nil {
+			benchOutput(m.Output, ts.URL)
+		}
+		if rcv.InvocationMetrics, err = NewInvocationMetrics(ctx, m); err != nil {
+			return err
+		}
+	}
+	pipeline, err := NewPipeline(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	// the logs of each request are too noisy for the benchmark
+	level := LogLevel.Level()
+	LogLevel.Set(level + 8)
+	defer LogLevel.Set(level)
+
+	res := runBench(ctx, rcv.Handler(pipeline), opt.Bench)
+	res.APICalls = sink.calls.Load()
+	res.Report(w)
+	return nil
+}
+
+// benchOutput points the output at the fake sink, which accepts any credentials.
+// The output calls no other AWS API.
+func benchOutput(out *OutputConfig, endpoint string) {
+	out.Endpoint = endpoint
+	out.RoleARN = ""
+	out.DeadLetter = ""
+	if out.Format == formatCloudWatchLogs {
+		cw := CloudWatchLogsConfig{}
+		if out.CloudWatchLogs != nil {
+			cw = *out.CloudWatchLogs
+		}
+		if cw.Owner == "" {
+			cw.Owner = "000000000000"
+		}
+		out.CloudWatchLogs = &cw
+	}
+	out.awsOptions = []func(*config.LoadOptions) error{
+		config.WithRegion("us-east-1"),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider("bench", "bench", "")),
+	}
+}
+
+func runBench(ctx context.Context, h http.Handler, opt BenchOption) *BenchResult {
+	body := benchEvents(opt.BatchSize, opt.LineSize, opt.JSON)
+	var interval time.Duration
+	if opt.Rate > 0 {
+		interval = time.Second * time.Duration(opt.BatchSize) / time.Duration(opt.Rate)
+	}
+	res := &BenchResult{}
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	ctx, cancel := context.WithTimeout(ctx, opt.Duration)
+	defer cancel()
+	start := time.Now()
+	next := start
+	lastSample := start
+	for ctx.Err() == nil {
+		if interval > 0 {
+			if d := time.Until(next); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+					continue
+				}
+			}
+			next = next.Add(interval)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		t := time.Now()
+		h.ServeHTTP(w, req)
+		res.Latencies = append(res.Latencies, time.Since(t))
+		res.Requests++
+		if w.Code != http.StatusOK {
+			res.FailedPosts++
+			continue
+		}
+		res.Events += opt.BatchSize
+		res.Bytes += opt.BatchSize * opt.LineSize
+		if time.Since(lastSample) > 100*time.Millisecond {
+			res.sampleHeap()
+			lastSample = time.Now()
+		}
+	}
+	res.Duration = time.Since(start)
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	res.Mallocs = after.Mallocs - before.Mallocs
+	res.TotalAlloc = after.TotalAlloc - before.TotalAlloc
+	res.sampleHeap()
+	return res
+}
+
+func (r *BenchResult) sampleHeap() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	r.MaxHeap = max(r.MaxHeap, m.HeapInuse)
+}
+
+// Percentile returns the p-th percentile (0-100) of the handler latencies.
+func (r *BenchResult) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(r.Latencies)
+	slices.Sort(sorted)
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+// Report writes the result in text.
+func (r *BenchResult) Report(w io.Writer) {
+	sec := r.Duration.Seconds()
+	events := max(r.Events, 1)
+	fmt.Fprintf(w, "duration:        %s\n", r.Duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "requests:        %d (failed %d)\n", r.Requests, r.FailedPosts)
+	fmt.Fprintf(w, "events:          %d (%.0f events/s)\n", r.Events, float64(r.Events)/sec)
+	fmt.Fprintf(w, "throughput:      %.2f MB/s\n", float64(r.Bytes)/sec/1024/1024)
+	fmt.Fprintf(w, "api calls:       %d\n", r.APICalls)
+	fmt.Fprintf(w, "latency p50:     %s\n", r.Percentile(50))
+	fmt.Fprintf(w, "latency p99:     %s\n", r.Percentile(99))
+	fmt.Fprintf(w, "latency max:     %s\n", r.Percentile(100))
+	fmt.Fprintf(w, "allocs/event:    %.1f\n", float64(r.Mallocs)/float64(events))
+	fmt.Fprintf(w, "bytes/event:     %.0f\n", float64(r.TotalAlloc)/float64(events))
+	fmt.Fprintf(w, "max heap in use: %.2f MB\n", float64(r.MaxHeap)/1024/1024)
+}
+
+// benchEvents returns a Telemetry API request body of the synthetic function events.
+func benchEvents(n, lineSize int, jsonRecord bool) []byte {
+	now := time.Now().UTC()
+	events := make([]map[string]any, 0, n)
+	for i := range n {
+		prefix := fmt.Sprintf("line %d ", i)
+		msg := prefix + strings.Repeat("x", max(lineSize-len(prefix), 0))
+		var record any = msg
+		if jsonRecord {
+			record = map[string]any{"level": "INFO", "message": msg}
+		}
+		events = append(events, map[string]any{
+			"time":   now.Add(time.Duration(i) * time.Microsecond).Format(time.RFC3339Nano),
+			"type":   "function",
+			"record": record,
+		})
+	}
+	b, _ := json.Marshal(events)
+	return b
+}
@@ -0,0 +1,199 @@
+package firetap_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/firetap"
+)
+
+// discardSender is a fake sink that discards the records.
+type discardSender struct{}
+
+func (discardSender) Send(context.Context, firetap.Record) error { return nil }
+func (discardSender) Flush(context.Context) error                { return nil }
+
+// newBenchPipeline creates a Pipeline that sends the records to a fake Firehose.
+func newBenchPipeline(b *testing.B) *firetap.Pipeline {
+	b.Helper()
+	b.Setenv("AWS_ACCESS_KEY_ID", "dummy")
+	b.Setenv("AWS_SECRET_ACCESS_KEY", "dummy")
+	b.Setenv("AWS_REGION", "us-east-1")
+	b.Setenv("AWS_MAX_ATTEMPTS", "1")
+	s := httptest.NewServer(&fakeFirehose{})
+	b.Cleanup(s.Close)
+	cfg, err := firetap.LoadConfig(&firetap.Option{StreamName: "bench"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := range cfg.Outputs {
+		cfg.Outputs[i].Endpoint = s.URL
+	}
+	p, err := firetap.NewPipeline(context.Background(), cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return p
+}
+
+func quiet(b *testing.B) {
+	level := firetap.LogLevel.Level()
+	firetap.LogLevel.Set(level + 8)
+	b.Cleanup(func() { firetap.LogLevel.Set(level) })
+}
+
+func benchmarkHandler(b *testing.B, h http.Handler, events, lineSize int, jsonRecord bool) {
+	body := firetap.BenchEvents(events, lineSize, jsonRecord)
+	latencies := make([]time.Duration, 0, b.N)
+	b.SetBytes(int64(events * lineSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(w, req)
+		latencies = append(latencies, time.Since(start))
+		if w.Code != http.StatusOK {
+			b.Fatalf("unexpected status: %d", w.Code)
+		}
+	}
+	b.StopTimer()
+	slices.Sort(latencies)
+	b.ReportMetric(float64(latencies[(len(latencies)-1)*99/100].Nanoseconds()), "p99-ns/op")
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*events), "ns/event")
+}
+
+func BenchmarkHandleTelemetry(b *testing.B) {
+	quiet(b)
+	for _, record := range []string{"text", "json"} {
+		for _, size := range []int{100, 1000} {
+			b.Run(fmt.Sprintf("%s/%dB", record, size), func(b *testing.B) {
+				h := (&firetap.Receiver{}).Handler(discardSender{})
+				benchmarkHandler(b, h, 100, size, record == "json")
+			})
+		}
+	}
+}
+
+func BenchmarkHandleTelemetryPipeline(b *testing.B) {
+	quiet(b)
+	for _, record := range []string{"text", "json"} {
+		b.Run(record, func(b *testing.B) {
+			h := (&firetap.Receiver{TagRecords: true}).Handler(newBenchPipeline(b))
+			benchmarkHandler(b, h, 100, 200, record == "json")
+		})
+	}
+}
+
+func BenchmarkPipelineSend(b *testing.B) {
+	quiet(b)
+	ctx := context.Background()
+	p := newBenchPipeline(b)
+	rec := firetap.Record{Time: time.Now(), Data: bytes.Repeat([]byte("x"), 200)}
+	b.SetBytes(int64(len(rec.Data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if err := p.Send(ctx, rec); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := p.Flush(ctx); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkAppendRecord(b *testing.B) {
+	for _, tc := range []struct {
+		name   string
+		record string
+	}{
+		{"text", `"` + string(bytes.Repeat([]byte("x"), 200)) + `"`},
+		{"json", `{"level":"INFO","message":"` + string(bytes.Repeat([]byte("x"), 200)) + `"}`},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(tc.record)))
+			raw := []byte(tc.record)
+			var buf []byte
+			b.ReportAllocs()
+			for range b.N {
+				var err error
+				if buf, err = firetap.AppendRecord(buf[:0], raw); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBench(t *testing.T) {
+	for name, config := range map[string]string{
+		"firehose": `
+outputs:
+  - type: firehose
+    stream_name: bench
+`,
+		"kinesis": `
+outputs:
+  - type: kinesis
+    stream_name: arn:aws:kinesis:us-west-2:123456789012:stream/bench
+    role_arn: arn:aws:iam::123456789012:role/firetap-writer
+`,
+		"cloudwatch_logs": `
+outputs:
+  - type: firehose
+    stream_name: bench
+    format: cloudwatch_logs
+invocation_metrics:
+  output:
+    type: kinesis
+    stream_name: invocation-metrics
+`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("AWS_ACCESS_KEY_ID", "caller")
+			path := filepath.Join(t.TempDir(), "firetap.yaml")
+			if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			opt := &firetap.Option{Config: path}
+			opt.Bench = firetap.BenchOption{Duration: 200 * time.Millisecond, BatchSize: 10, LineSize: 100}
+			var out bytes.Buffer
+			if err := firetap.BenchTo(opt, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out.String(), "(failed 0)") || strings.Contains(out.String(), "api calls:       0\n") {
+				t.Errorf("the records must be sent to the fake sink: %s", out.String())
+			}
+			if v := os.Getenv("AWS_ACCESS_KEY_ID"); v != "caller" {
+				t.Errorf("the environment must not be changed: %q", v)
+			}
+		})
+	}
+}
+
+func TestBenchEvents(t *testing.T) {
+	for _, jsonRecord := range []bool{false, true} {
+		sender := &testLogSender{}
+		h := (&firetap.Receiver{}).Handler(sender)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(firetap.BenchEvents(10, 50, jsonRecord)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status: %d", w.Code)
+		}
+		if n := bytes.Count([]byte(sender.String()), []byte("\n")); n != 10 {
+			t.Errorf("records = %d, want 10", n)
+		}
+	}
+}
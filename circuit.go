@@ -0,0 +1,187 @@
+package firetap
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultOpenDuration = 30 * time.Second
+
+	// quotas of a Kinesis shard
+	shardRecordsPerSecond = 1000
+	shardBytesPerSecond   = 1024 * 1024
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// errCircuitOpen is returned when the flush is skipped by the open circuit.
+type errCircuitOpen struct {
+	stream string
+	until  time.Time
+}
+
+func (e *errCircuitOpen) Error() string {
+	return fmt.Sprintf("circuit of %s is open until %s", e.stream, e.until.Format(time.RFC3339))
+}
+
+// circuitBreaker opens after the consecutive failed flushes to a stream.
+// After openDuration, it allows a trial flush (half-open). The success closes the circuit
+// and the failure opens it again. A threshold of zero or less disables it.
+//
+// It is not safe for concurrent use. LogSender guards it by its mutex.
+type circuitBreaker struct {
+	threshold    int
+	openDuration time.Duration
+	state        circuitState
+	failures     int
+	openedAt     time.Time
+	now          func() time.Time
+}
+
+func newCircuitBreaker(cfg CircuitBreakerConfig) *circuitBreaker {
+	c := &circuitBreaker{
+		threshold:    cfg.FailureThreshold,
+		openDuration: time.Duration(cfg.OpenDuration),
+		now:          time.Now,
+	}
+	if c.openDuration <= 0 {
+		c.openDuration = defaultOpenDuration
+	}
+	return c
+}
+
+// allow reports whether a flush is allowed, and moves an open circuit to half-open after openDuration.
+func (c *circuitBreaker) allow() bool {
+	if c.threshold <= 0 {
+		return true // disabled
+	}
+	if c.state == circuitOpen {
+		if c.now().Sub(c.openedAt) < c.openDuration {
+			return false
+		}
+		c.state = circuitHalfOpen
+	}
+	return true
+}
+
+// success records a successful flush and returns true when the circuit is closed by it.
+func (c *circuitBreaker) success() bool {
+	closed := c.state != circuitClosed
+	c.state = circuitClosed
+	c.failures = 0
+	return closed
+}
+
+// failure records a failed flush and returns true when the circuit is opened by it.
+func (c *circuitBreaker) failure() bool {
+	if c.threshold <= 0 {
+		return false
+	}
+	c.failures++
+	if c.state == circuitHalfOpen || c.failures >= c.threshold {
+		opened := c.state != circuitOpen
+		c.state = circuitOpen
+		c.openedAt = c.now()
+		return opened
+	}
+	return false
+}
+
+func (c *circuitBreaker) openUntil() time.Time {
+	return c.openedAt.Add(c.openDuration)
+}
+
+// rateLimiter limits the records and bytes per second sent to a stream.
+// A nil rateLimiter does not limit.
+type rateLimiter struct {
+	records *rate.Limiter
+	bytes   *rate.Limiter
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	records, bytes := cfg.RecordsPerSecond, cfg.BytesPerSecond
+	if cfg.Shards > 0 {
+		if records == 0 {
+			records = cfg.Shards * shardRecordsPerSecond
+		}
+		if bytes == 0 {
+			bytes = cfg.Shards * shardBytesPerSecond
+		}
+	}
+	if records == 0 && bytes == 0 {
+		return nil
+	}
+	l := &rateLimiter{}
+	if records > 0 {
+		l.records = rate.NewLimiter(rate.Limit(records), records)
+	}
+	if bytes > 0 {
+		l.bytes = rate.NewLimiter(rate.Limit(bytes), bytes)
+	}
+	return l
+}
+
+// errRateLimit is returned when the wait for the rate limit fails.
+// It is not counted as a failure of the stream by the circuit breaker.
+type errRateLimit struct {
+	err error
+}
+
+func (e *errRateLimit) Error() string {
+	return "rate limit: " + e.err.Error()
+}
+
+func (e *errRateLimit) Unwrap() error {
+	return e.err
+}
+
+// wait blocks until the records and bytes are allowed. It returns an errRateLimit
+// when ctx is done or the wait exceeds the deadline of ctx.
+func (l *rateLimiter) wait(ctx context.Context, records, bytes int) error {
+	if l == nil {
+		return nil
+	}
+	if err := waitN(ctx, l.records, records); err != nil {
+		return &errRateLimit{err: err}
+	}
+	if err := waitN(ctx, l.bytes, bytes); err != nil {
+		return &errRateLimit{err: err}
+	}
+	return nil
+}
+
+// waitN waits for n tokens by the chunks of the burst, so a batch larger than the quota per second is allowed.
+func waitN(ctx context.Context, l *rate.Limiter, n int) error {
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		k := min(n, l.Burst())
+		if err := l.WaitN(ctx, k); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package firetap_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/firetap"
+)
+
+// fakeFirehose is a stand-in of the Firehose API that records the data.
+type fakeFirehose struct {
+	mu       sync.Mutex
+	requests int
+	down     bool
+	records  []string
+}
+
+func (f *fakeFirehose) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	if f.down {
+		w.Header().Set("X-Amzn-ErrorType", "ServiceUnavailableException")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"__type":"ServiceUnavailableException","message":"down"}`))
+		return
+	}
+	var in struct {
+		Records []struct{ Data []byte }
+	}
+	json.NewDecoder(r.Body).Decode(&in)
+	for _, r := range in.Records {
+		f.records = append(f.records, string(r.Data))
+	}
+	w.Write([]byte(`{"Encrypted":false,"FailedPutCount":0,"RequestResponses":[]}`))
+}
+
+func (f *fakeFirehose) set(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *fakeFirehose) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+// recorded returns the data of the records put successfully.
+func (f *fakeFirehose) recorded() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.records)
+}
+
+func newFakeFirehoseSender(t testing.TB, f *fakeFirehose, cfg firetap.OutputConfig) *firetap.LogSender {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "dummy")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "dummy")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_MAX_ATTEMPTS", "1")
+	s := httptest.NewServer(f)
+	t.Cleanup(s.Close)
+	cfg.Type = "firehose"
+	if cfg.StreamName == "" {
+		cfg.StreamName = "test"
+	}
+	cfg.Endpoint = s.URL
+	cfg.Batch = firetap.BatchConfig{MaxRecords: 500, MaxBytes: 1024 * 512}
+	cfg.Retry = firetap.RetryConfig{MinDelay: firetap.Duration(time.Millisecond), MaxDelay: firetap.Duration(time.Millisecond), MaxCount: 2}
+	sender, err := firetap.NewSender(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeFirehose{down: true}
+	s := newFakeFirehoseSender(t, f, firetap.OutputConfig{
+		CircuitBreaker: firetap.CircuitBreakerConfig{
+			FailureThreshold: 2,
+			OpenDuration:     firetap.Duration(300 * time.Millisecond),
+		},
+	})
+	if err := s.Send(ctx, firetap.Record{Data: []byte("hello\n")}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Flush(ctx); err == nil {
+			t.Fatal("flush must fail")
+		}
+	}
+	if n := f.count(); n != 4 {
+		t.Errorf("requests = %d, want 4 (2 flushes with 2 attempts)", n)
+	}
+	if st := s.Status(); !slices.Equal(st.OpenCircuits, []string{"test"}) {
+		t.Errorf("unexpected open circuits: %v", st.OpenCircuits)
+	}
+
+	// the open circuit does not call the API and keeps the records
+	err := s.Flush(ctx)
+	if err == nil || f.count() != 4 {
+		t.Errorf("flush must be skipped: %v requests=%d", err, f.count())
+	}
+	if s.Len() != 1 {
+		t.Errorf("records must be kept: %d", s.Len())
+	}
+
+	// half-open: a trial flush without retries fails and opens the circuit again
+	time.Sleep(300 * time.Millisecond)
+	if err := s.Flush(ctx); err == nil {
+		t.Fatal("flush must fail")
+	}
+	if n := f.count(); n != 5 {
+		t.Errorf("requests = %d, want 5", n)
+	}
+
+	// recovered
+	f.set(false)
+	time.Sleep(300 * time.Millisecond)
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); len(st.OpenCircuits) != 0 || st.BufferRecords != 0 {
+		t.Errorf("circuit must be closed and the buffer must be empty: %#v", st)
+	}
+}
+
+type testDeadLetter struct {
+	entries []firetap.DeadLetterEntry
+}
+
+func (d *testDeadLetter) Put(_ context.Context, entries []firetap.DeadLetterEntry) error {
+	d.entries = append(d.entries, entries...)
+	return nil
+}
+
+func TestCircuitBreakerDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeFirehose{down: true}
+	s := newFakeFirehoseSender(t, f, firetap.OutputConfig{
+		CircuitBreaker: firetap.CircuitBreakerConfig{FailureThreshold: 1, OpenDuration: firetap.Duration(time.Minute)},
+	})
+	dl := &testDeadLetter{}
+	firetap.SetDeadLetter(s, dl)
+	for i := 0; i < 3; i++ {
+		if err := s.Send(ctx, firetap.Record{Data: []byte("hello\n")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := f.count(); n != 2 {
+		t.Errorf("requests = %d, want 2 (only the first flush)", n)
+	}
+	if len(dl.entries) != 3 {
+		t.Fatalf("dead letter entries = %d, want 3", len(dl.entries))
+	}
+	if reason := dl.entries[2].Reason; !strings.Contains(reason, "circuit of test is open") {
+		t.Errorf("unexpected reason: %s", reason)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeFirehose{}
+	s := newFakeFirehoseSender(t, f, firetap.OutputConfig{
+		RateLimit: firetap.RateLimitConfig{RecordsPerSecond: 20},
+	})
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		if err := s.Send(ctx, firetap.Record{Data: []byte("hello\n")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the burst is 20 records, and the rest 10 records take 0.5s
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("rate limit is not applied: %s", elapsed)
+	}
+}
+
+func TestCircuitBreakerDisabledByDefault(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeFirehose{down: true}
+	s := newFakeFirehoseSender(t, f, firetap.OutputConfig{})
+	s.Send(ctx, firetap.Record{Data: []byte("hello\n")})
+	for i := 0; i < 5; i++ {
+		if err := s.Flush(ctx); err == nil {
+			t.Fatal("flush must fail")
+		}
+	}
+	if n := f.count(); n != 10 {
+		t.Errorf("requests = %d, want 10 (5 flushes with 2 attempts)", n)
+	}
+	if st := s.Status(); len(st.OpenCircuits) != 0 {
+		t.Errorf("circuit must not be opened: %v", st.OpenCircuits)
+	}
+}
+
+func TestRateLimitOtherStreams(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeFirehose{}
+	s := newFakeFirehoseSender(t, f, firetap.OutputConfig{
+		StreamName: "logs-{{.tenant}}",
+		MaxStreams: 10,
+		RateLimit:  firetap.RateLimitConfig{RecordsPerSecond: 1},
+	})
+	// the burst of "logs-a" is consumed
+	s.Send(ctx, firetap.Record{Data: []byte(`{"tenant":"a"}` + "\n")})
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// "logs-a" waits for the rate limit about 1s
+	s.Send(ctx, firetap.Record{Data: []byte(`{"tenant":"a"}` + "\n")})
+	done := make(chan error)
+	go func() {
+		done <- s.Flush(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if err := s.Send(ctx, firetap.Record{Data: []byte(`{"tenant":"b"}` + "\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); st.BufferRecords != 2 {
+		t.Errorf("unexpected buffer: %#v", st)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the other stream must not wait for the rate limit: %s", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimitIsNotFailure(t *testing.T) {
+	f := &fakeFirehose{}
+	s := newFakeFirehoseSender(t, f, firetap.OutputConfig{
+		CircuitBreaker: firetap.CircuitBreakerConfig{FailureThreshold: 1, OpenDuration: firetap.Duration(time.Minute)},
+		RateLimit:      firetap.RateLimitConfig{RecordsPerSecond: 1},
+	})
+	s.Send(context.Background(), firetap.Record{Data: []byte("hello\n")})
+	s.Send(context.Background(), firetap.Record{Data: []byte("hello\n")})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := s.Flush(ctx)
+	if err == nil || !strings.Contains(err.Error(), "rate limit") {
+		t.Fatalf("flush must fail by the rate limit: %v", err)
+	}
+	if st := s.Status(); len(st.OpenCircuits) != 0 || st.BufferRecords != 2 {
+		t.Errorf("the rate limit must not open the circuit and the records must be kept: %#v", st)
+	}
+}
+
+func TestEncodeFailureDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeFirehose{}
+	s := newFakeFirehoseSender(t, f, firetap.OutputConfig{})
+	firetap.SetEncodeError(s, errors.New("broken"))
+	if err := s.Send(ctx, firetap.Record{Data: []byte("hello\n")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// without the dead letter, the records are kept to retry
+	if err := s.Flush(ctx); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("flush must fail: %v", err)
+	}
+	if s.Len() != 1 || f.count() != 0 {
+		t.Fatalf("records must be kept: len=%d requests=%d", s.Len(), f.count())
+	}
+
+	dl := &testDeadLetter{}
+	firetap.SetDeadLetter(s, dl)
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 0 {
+		t.Errorf("records must be moved to the dead letter: %d", s.Len())
+	}
+	if len(dl.entries) != 1 || dl.entries[0].Record != "hello\n" || !strings.Contains(dl.entries[0].Reason, "failed to encode records") {
+		t.Errorf("unexpected dead letter entries: %+v", dl.entries)
+	}
+}
@@ -21,13 +21,32 @@ func run(ctx context.Context) error {
 	if h := os.Getenv("_HANDLER"); h != "" {
 		// in runtime
 		ctx = slogcontext.WithValue(ctx, "type", "firetap.wrapper")
-		return app.Wrapper(ctx, h)
+		opt, err := app.NewWrapperOption()
+		if err != nil {
+			return err
+		}
+		return app.Wrapper(ctx, h, opt)
 	}
-	// otherwise, in extension
 	opt, err := app.NewOption()
 	if err != nil {
 		return err
 	}
-	ctx = slogcontext.WithValue(ctx, "type", "firetap.extension")
-	return app.Run(ctx, opt)
+	switch opt.Command() {
+	case "send":
+		ctx = slogcontext.WithValue(ctx, "type", "firetap.send")
+		return app.Send(ctx, opt)
+	case "tail":
+		ctx = slogcontext.WithValue(ctx, "type", "firetap.tail")
+		return app.Tail(ctx, opt)
+	case "validate":
+		ctx = slogcontext.WithValue(ctx, "type", "firetap.validate")
+		return app.Validate(ctx, opt)
+	case "bench":
+		ctx = slogcontext.WithValue(ctx, "type", "firetap.bench")
+		return app.Bench(ctx, opt)
+	default:
+		// otherwise, in extension
+		ctx = slogcontext.WithValue(ctx, "type", "firetap.extension")
+		return app.Run(ctx, opt)
+	}
 }
@@ -0,0 +1,623 @@
+package firetap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	outputTypeFirehose = "firehose"
+	outputTypeKinesis  = "kinesis"
+
+	processorTypeFilter = "filter"
+	processorTypeSample = "sample"
+	processorTypeParse  = "parse"
+	processorTypeJQ     = "jq"
+)
+
+// Config represents the pipeline configuration.
+type Config struct {
+	Inputs     InputConfig       `json:"inputs"`
+	Processors []ProcessorConfig `json:"processors,omitempty"`
+	Outputs    []OutputConfig    `json:"outputs"`
+	// InvocationMetrics emits the metrics of the invocations derived from the platform.report events.
+	InvocationMetrics *InvocationMetricsConfig `json:"invocation_metrics,omitempty"`
+	// Traces exports the spans of the platform events as OpenTelemetry traces.
+	Traces *TracesConfig `json:"traces,omitempty"`
+	// Wrapper configures the wrapper mode, in which firetap runs the handler by _HANDLER.
+	Wrapper WrapperConfig `json:"wrapper,omitempty"`
+}
+
+// WrapperConfig represents the wrapper of the handler.
+type WrapperConfig struct {
+	// StderrPassthrough also writes the stderr of the handler to the real stderr.
+	StderrPassthrough bool `json:"stderr_passthrough,omitempty"`
+	// RuntimeProxy runs a proxy of the Lambda Runtime API for the handler.
+	RuntimeProxy bool `json:"runtime_proxy,omitempty"`
+	// Buffer bounds the lines buffered while they are not passed to the extension.
+	Buffer WrapperBufferConfig `json:"buffer,omitempty"`
+}
+
+// WrapperBufferConfig represents the budget of the lines buffered by the wrapper.
+type WrapperBufferConfig struct {
+	MaxEvents int `json:"max_events,omitempty"`
+	MaxBytes  int `json:"max_bytes,omitempty"`
+	// DropPolicy is the behavior on exceeding the buffer (block, drop_oldest or drop_newest).
+	DropPolicy string `json:"drop_policy,omitempty"`
+}
+
+// InputConfig represents the telemetry to receive.
+type InputConfig struct {
+	// Types are the telemetry types to pass to the processors (function, platform, extension).
+	Types      []string            `json:"types"`
+	TagRecords bool                `json:"tag_records,omitempty"`
+	Buffering  *TelemetryBuffering `json:"buffering,omitempty"`
+	// TimestampField adds the time of the telemetry event to the function records
+	// as the field in RFC3339 with nanoseconds.
+	TimestampField string `json:"timestamp_field,omitempty"`
+	// IDField adds {"id": time-ordered unique ID, "sandbox": sandbox ID, "seq": sequence number}
+	// to the function records as the field, for the consumers to dedupe and to detect gaps.
+	IDField string `json:"id_field,omitempty"`
+	// TraceContext adds "trace_id" and "span_id" of the invocation to the function records.
+	TraceContext bool `json:"trace_context,omitempty"`
+}
+
+// ProcessorConfig represents a processor applied to each record.
+type ProcessorConfig struct {
+	Type string `json:"type"`
+
+	FilterConfig
+
+	// sample
+	Rate float64 `json:"rate,omitempty"`
+
+	// parse
+	Format  string `json:"format,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+
+	// jq
+	Expr    string   `json:"expr,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// OutputConfig represents a destination stream.
+type OutputConfig struct {
+	Name       string `json:"name,omitempty"`
+	Type       string `json:"type"`
+	StreamName string `json:"stream_name"` // name, ARN or template like "logs-{{.tenant}}"
+	// FallbackStream receives the records that the stream name template does not resolve.
+	FallbackStream string `json:"fallback_stream,omitempty"`
+	// MaxStreams is the max number of the distinct streams resolved by the template.
+	MaxStreams  int           `json:"max_streams,omitempty"`
+	Region      string        `json:"region,omitempty"`
+	Endpoint    string        `json:"endpoint,omitempty"`
+	RoleARN     string        `json:"role_arn,omitempty"`
+	ExternalID  string        `json:"external_id,omitempty"`
+	SessionName string        `json:"session_name,omitempty"`
+	Filter      *FilterConfig `json:"filter,omitempty"`
+	Batch       BatchConfig   `json:"batch,omitempty"`
+	Retry       RetryConfig   `json:"retry,omitempty"`
+	DeadLetter  string        `json:"dead_letter,omitempty"`
+	// Ordered puts the records to a Kinesis Data Stream one by one with SequenceNumberForOrdering.
+	Ordered bool `json:"ordered,omitempty"`
+	// CircuitBreaker and RateLimit are applied to each stream.
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+	RateLimit      RateLimitConfig      `json:"rate_limit,omitempty"`
+	// Format is the format of the records put to the stream (raw, cloudwatch_logs).
+	Format         string                `json:"format,omitempty"`
+	CloudWatchLogs *CloudWatchLogsConfig `json:"cloudwatch_logs,omitempty"`
+
+	// awsOptions are applied to the AWS config of the output before the region of the output.
+	awsOptions []func(*config.LoadOptions) error
+}
+
+// InvocationMetricsConfig represents the metrics of the invocations derived from the platform.report events.
+type InvocationMetricsConfig struct {
+	// Format is emf (CloudWatch Embedded Metric Format documents) or record (compact JSON records).
+	Format    string `json:"format,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	// Output is the destination of the metrics. Without it, the metrics are written to stdout,
+	// which is sent to CloudWatch Logs by Lambda.
+	Output *OutputConfig `json:"output,omitempty"`
+	// Aggregate aggregates the invocations in the period like "1m" into the percentiles,
+	// instead of emitting the metrics for each invocation.
+	Aggregate   Duration  `json:"aggregate,omitempty"`
+	Percentiles []float64 `json:"percentiles,omitempty"`
+}
+
+// TracesConfig represents the OTLP/HTTP exporter of the spans of the platform events.
+type TracesConfig struct {
+	// Endpoint is the OTLP/HTTP endpoint like "http://localhost:4318".
+	// "/v1/traces" is appended to the endpoint without a path.
+	Endpoint    string            `json:"endpoint"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+	// SampledOnly exports the spans of the invocations sampled by the incoming trace context only.
+	SampledOnly bool     `json:"sampled_only,omitempty"`
+	Timeout     Duration `json:"timeout,omitempty"`
+}
+
+// CloudWatchLogsConfig overrides the fields of the CloudWatch Logs subscription envelope.
+// The defaults are the account of the function, AWS_LAMBDA_LOG_GROUP_NAME and AWS_LAMBDA_LOG_STREAM_NAME.
+type CloudWatchLogsConfig struct {
+	Owner     string `json:"owner,omitempty"`
+	LogGroup  string `json:"log_group,omitempty"`
+	LogStream string `json:"log_stream,omitempty"`
+}
+
+// FilterConfig represents a filter of the records by regular expressions.
+type FilterConfig struct {
+	Include string `json:"include,omitempty"`
+	Exclude string `json:"exclude,omitempty"`
+}
+
+type BatchConfig struct {
+	MaxRecords int `json:"max_records,omitempty"`
+	MaxBytes   int `json:"max_bytes,omitempty"`
+}
+
+type RetryConfig struct {
+	MinDelay Duration `json:"min_delay,omitempty"`
+	MaxDelay Duration `json:"max_delay,omitempty"`
+	MaxCount int      `json:"max_count,omitempty"`
+}
+
+// CircuitBreakerConfig represents the circuit breaker of a stream.
+// The circuit breaker is disabled unless FailureThreshold is positive.
+type CircuitBreakerConfig struct {
+	FailureThreshold int      `json:"failure_threshold,omitempty"`
+	OpenDuration     Duration `json:"open_duration,omitempty"`
+}
+
+// RateLimitConfig represents the client-side rate limit of a stream.
+// Shards sets the quotas of Kinesis shards (1000 records and 1MB per second per shard)
+// unless RecordsPerSecond or BytesPerSecond is set.
+type RateLimitConfig struct {
+	RecordsPerSecond int `json:"records_per_second,omitempty"`
+	BytesPerSecond   int `json:"bytes_per_second,omitempty"`
+	Shards           int `json:"shards,omitempty"`
+}
+
+// Duration is a time.Duration represented as a string like "100ms" in the configuration.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"100ms\": %s", string(b))
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DefaultConfig returns the configuration equivalent to no configuration file.
+func DefaultConfig() *Config {
+	return &Config{
+		Inputs: InputConfig{
+			Types: []string{"function"},
+		},
+		Outputs: []OutputConfig{
+			{Type: outputTypeFirehose},
+		},
+	}
+}
+
+// LoadConfig loads the configuration file specified by the option, and overrides it by the flags.
+// Without the configuration file, it returns the configuration built from the flags.
+func LoadConfig(opt *Option) (*Config, error) {
+	cfg := DefaultConfig()
+	if opt.Config != "" {
+		path, err := resolveConfigPath(opt.Config)
+		if err != nil {
+			return nil, err
+		}
+		if cfg, err = readConfig(path); err != nil {
+			return nil, fmt.Errorf("failed to load config %s: %w", path, err)
+		}
+	}
+	cfg.override(opt)
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// resolveConfigPath finds a relative path in the current directory, the function package and the layers.
+func resolveConfigPath(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+	for _, dir := range []string{".", os.Getenv("LAMBDA_TASK_ROOT"), "/opt"} {
+		if dir == "" {
+			continue
+		}
+		p := filepath.Join(dir, path)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("config file %s is not found", path)
+}
+
+func readConfig(path string) (*Config, error) {
+	var b []byte
+	var err error
+	switch filepath.Ext(path) {
+	case ".jsonnet", ".libsonnet":
+		vm := jsonnet.MakeVM()
+		for _, f := range jsonnetNativeFunctions {
+			vm.NativeFunction(f)
+		}
+		var s string
+		if s, err = vm.EvaluateFile(path); err != nil {
+			return nil, err
+		}
+		b = []byte(s)
+	case ".yaml", ".yml":
+		if b, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+		if b, err = yaml.YAMLToJSON(expandEnv(b)); err != nil {
+			return nil, err
+		}
+	default:
+		if b, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+		b = expandEnv(b)
+	}
+	return parseConfig(b)
+}
+
+// parseConfig decodes the configuration strictly. Unknown fields are errors.
+func parseConfig(b []byte) (*Config, error) {
+	cfg := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expandEnv expands ${VAR} and ${VAR:-default} in YAML and JSON files.
+func expandEnv(b []byte) []byte {
+	return envPattern.ReplaceAllFunc(b, func(m []byte) []byte {
+		sub := envPattern.FindSubmatch(m)
+		if v, ok := os.LookupEnv(string(sub[1])); ok && v != "" {
+			return []byte(v)
+		}
+		return sub[2]
+	})
+}
+
+// jsonnetNativeFunctions are available as std.native("env")("NAME", "default") and std.native("must_env")("NAME").
+var jsonnetNativeFunctions = []*jsonnet.NativeFunction{
+	{
+		Name:   "env",
+		Params: []ast.Identifier{"name", "default"},
+		Func: func(args []any) (any, error) {
+			name, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("env: name must be a string")
+			}
+			if v, ok := os.LookupEnv(name); ok {
+				return v, nil
+			}
+			return args[1], nil
+		},
+	},
+	{
+		Name:   "must_env",
+		Params: []ast.Identifier{"name"},
+		Func: func(args []any) (any, error) {
+			name, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("must_env: name must be a string")
+			}
+			if v, ok := os.LookupEnv(name); ok {
+				return v, nil
+			}
+			return nil, fmt.Errorf("must_env: %s is not set", name)
+		},
+	},
+}
+
+// override applies the flags to the configuration. The flags are applied to the first output.
+func (c *Config) override(opt *Option) {
+	if opt.TagRecords {
+		c.Inputs.TagRecords = true
+	}
+	if len(c.Outputs) == 0 {
+		c.Outputs = append(c.Outputs, OutputConfig{Type: outputTypeFirehose})
+	}
+	out := &c.Outputs[0]
+	if opt.StreamName != "" {
+		out.StreamName = opt.StreamName
+	}
+	if opt.DataStream {
+		out.Type = outputTypeKinesis
+	}
+	if opt.DeadLetter != "" {
+		out.DeadLetter = opt.DeadLetter
+	}
+	if opt.StderrPassthrough {
+		c.Wrapper.StderrPassthrough = true
+	}
+	if opt.RuntimeProxy {
+		c.Wrapper.RuntimeProxy = true
+	}
+	if opt.BufferMaxEvents != 0 {
+		c.Wrapper.Buffer.MaxEvents = opt.BufferMaxEvents
+	}
+	if opt.BufferMaxBytes != 0 {
+		c.Wrapper.Buffer.MaxBytes = opt.BufferMaxBytes
+	}
+	if opt.DropPolicy != "" {
+		c.Wrapper.Buffer.DropPolicy = opt.DropPolicy
+	}
+}
+
+func (c *Config) setDefaults() {
+	if len(c.Inputs.Types) == 0 {
+		c.Inputs.Types = []string{"function"}
+	}
+	for i := range c.Outputs {
+		c.Outputs[i].setDefaults()
+	}
+	if b := &c.Wrapper.Buffer; b.MaxEvents == 0 {
+		b.MaxEvents = defaultBudgetEvents
+	}
+	if b := &c.Wrapper.Buffer; b.MaxBytes == 0 {
+		b.MaxBytes = defaultBudgetBytes
+	}
+	if b := &c.Wrapper.Buffer; b.DropPolicy == "" {
+		b.DropPolicy = DropPolicyDropOldest
+	}
+	if m := c.InvocationMetrics; m != nil {
+		if m.Format == "" {
+			m.Format = invocationMetricsFormatEMF
+		}
+		if m.Namespace == "" {
+			m.Namespace = defaultInvocationMetricsNamespace
+		}
+		if len(m.Percentiles) == 0 {
+			m.Percentiles = defaultInvocationMetricsPercentiles
+		}
+		if m.Output != nil {
+			m.Output.setDefaults()
+		}
+	}
+}
+
+func (out *OutputConfig) setDefaults() {
+	if out.Type == "" {
+		out.Type = outputTypeFirehose
+	}
+	if out.Name == "" {
+		out.Name = out.StreamName
+		if dest, err := parseDestination(out.StreamName); err == nil {
+			out.Name = dest.name
+		}
+	}
+	if out.Format == "" {
+		out.Format = formatRaw
+	}
+	if out.MaxStreams == 0 {
+		out.MaxStreams = defaultMaxStreams
+	}
+	if out.Batch.MaxRecords == 0 {
+		out.Batch.MaxRecords = maxBatchSize
+	}
+	if out.Batch.MaxBytes == 0 {
+		out.Batch.MaxBytes = maxBatchBytes
+	}
+	if out.Retry.MinDelay == 0 {
+		out.Retry.MinDelay = Duration(retryPolicy.MinDelay)
+	}
+	if out.Retry.MaxDelay == 0 {
+		out.Retry.MaxDelay = Duration(retryPolicy.MaxDelay)
+	}
+	if out.Retry.MaxCount == 0 {
+		out.Retry.MaxCount = retryPolicy.MaxCount
+	}
+	if out.CircuitBreaker.OpenDuration == 0 {
+		out.CircuitBreaker.OpenDuration = Duration(defaultOpenDuration)
+	}
+}
+
+// Validate validates the configuration.
+func (c *Config) Validate() error {
+	var errs []error
+	for _, t := range c.Inputs.Types {
+		switch t {
+		case "function", "platform", "extension":
+		default:
+			errs = append(errs, fmt.Errorf("inputs.types: unknown type %q", t))
+		}
+	}
+	errs = append(errs, validateProcessors(c.Processors)...)
+	if b := c.Wrapper.Buffer; b.MaxEvents < 0 || b.MaxBytes < 0 {
+		errs = append(errs, errors.New("wrapper.buffer: max_events and max_bytes must be positive"))
+	}
+	switch p := c.Wrapper.Buffer.DropPolicy; p {
+	case DropPolicyBlock, DropPolicyDropOldest, DropPolicyDropNewest:
+	default:
+		errs = append(errs, fmt.Errorf("wrapper.buffer.drop_policy: unknown policy %q", p))
+	}
+	if len(c.Outputs) == 0 {
+		errs = append(errs, errors.New("outputs: at least one output is required"))
+	}
+	names := map[string]bool{}
+	for i, out := range c.Outputs {
+		field := fmt.Sprintf("outputs[%d]", i)
+		errs = append(errs, out.validate(field)...)
+		if names[out.Name] {
+			errs = append(errs, fmt.Errorf("%s.name: duplicated name %q", field, out.Name))
+		}
+		names[out.Name] = true
+	}
+	if m := c.InvocationMetrics; m != nil {
+		switch m.Format {
+		case invocationMetricsFormatEMF, invocationMetricsFormatRecord:
+		default:
+			errs = append(errs, fmt.Errorf("invocation_metrics.format: unknown format %q", m.Format))
+		}
+		if m.Aggregate < 0 || (m.Aggregate > 0 && m.Aggregate < Duration(time.Second)) {
+			errs = append(errs, fmt.Errorf("invocation_metrics.aggregate: must be 1s or longer"))
+		}
+		for _, p := range m.Percentiles {
+			if p <= 0 || p > 100 {
+				errs = append(errs, fmt.Errorf("invocation_metrics.percentiles: must be in (0, 100]: %v", p))
+			}
+		}
+		if m.Output != nil {
+			errs = append(errs, m.Output.validate("invocation_metrics.output")...)
+		}
+	}
+	if tr := c.Traces; tr != nil {
+		if _, err := otlpTracesEndpoint(tr.Endpoint); err != nil {
+			errs = append(errs, fmt.Errorf("traces.endpoint: %w", err))
+		}
+		if tr.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("traces.timeout: must be positive"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (out *OutputConfig) validate(field string) []error {
+	var errs []error
+	switch out.Type {
+	case outputTypeFirehose, outputTypeKinesis:
+	default:
+		errs = append(errs, fmt.Errorf("%s.type: unknown type %q", field, out.Type))
+	}
+	if out.StreamName == "" {
+		errs = append(errs, fmt.Errorf("%s.stream_name: required", field))
+	} else if isStreamTemplate(out.StreamName) {
+		if _, err := newStreamTemplate(out.StreamName); err != nil {
+			errs = append(errs, fmt.Errorf("%s.stream_name: %w", field, err))
+		}
+		if out.FallbackStream != "" && !streamNamePattern.MatchString(out.FallbackStream) {
+			errs = append(errs, fmt.Errorf("%s.fallback_stream: invalid stream name %q", field, out.FallbackStream))
+		}
+	} else if _, err := parseDestination(out.StreamName); err != nil {
+		errs = append(errs, fmt.Errorf("%s.stream_name: %w", field, err))
+	}
+	switch out.Format {
+	case formatRaw, formatCloudWatchLogs:
+	default:
+		errs = append(errs, fmt.Errorf("%s.format: unknown format %q", field, out.Format))
+	}
+	if out.MaxStreams < 0 {
+		errs = append(errs, fmt.Errorf("%s.max_streams: must be positive", field))
+	}
+	if out.RoleARN != "" && !arn.IsARN(out.RoleARN) {
+		errs = append(errs, fmt.Errorf("%s.role_arn: invalid ARN %q", field, out.RoleARN))
+	}
+	if out.Endpoint != "" {
+		if u, err := url.Parse(out.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s.endpoint: invalid URL %q", field, out.Endpoint))
+		}
+	}
+	if out.Filter != nil {
+		errs = append(errs, validateFilter(field+".filter", out.Filter.Include, out.Filter.Exclude)...)
+	}
+	if out.Batch.MaxRecords < 0 || out.Batch.MaxRecords > maxBatchSize {
+		errs = append(errs, fmt.Errorf("%s.batch.max_records: must be 1-%d", field, maxBatchSize))
+	}
+	if out.Batch.MaxBytes < 0 || out.Batch.MaxBytes > maxBatchBytes {
+		errs = append(errs, fmt.Errorf("%s.batch.max_bytes: must be 1-%d", field, maxBatchBytes))
+	}
+	if out.Retry.MinDelay > out.Retry.MaxDelay {
+		errs = append(errs, fmt.Errorf("%s.retry: min_delay must be less than max_delay", field))
+	}
+	if out.Ordered && out.Type != outputTypeKinesis {
+		errs = append(errs, fmt.Errorf("%s.ordered: only for kinesis", field))
+	}
+	if out.CircuitBreaker.OpenDuration < 0 {
+		errs = append(errs, fmt.Errorf("%s.circuit_breaker.open_duration: must be positive", field))
+	}
+	if out.RateLimit.RecordsPerSecond < 0 || out.RateLimit.BytesPerSecond < 0 || out.RateLimit.Shards < 0 {
+		errs = append(errs, fmt.Errorf("%s.rate_limit: must be positive", field))
+	}
+	if out.DeadLetter != "" && !strings.Contains(out.DeadLetter, "://") {
+		errs = append(errs, fmt.Errorf("%s.dead_letter: must be a URL", field))
+	}
+	return errs
+}
+
+func validateProcessors(procs []ProcessorConfig) []error {
+	var errs []error
+	for i, p := range procs {
+		field := fmt.Sprintf("processors[%d]", i)
+		switch p.Type {
+		case processorTypeFilter:
+			errs = append(errs, validateFilter(field, p.Include, p.Exclude)...)
+		case processorTypeSample:
+			if p.Rate < 0 || p.Rate > 1 {
+				errs = append(errs, fmt.Errorf("%s.rate: must be 0-1", field))
+			}
+		case processorTypeParse:
+			switch p.Format {
+			case parseFormatLogfmt, parseFormatLambda, parseFormatPython, parseFormatNode, parseFormatAuto:
+			case parseFormatRegexp:
+				if _, err := compileParsePattern(p.Pattern); err != nil {
+					errs = append(errs, fmt.Errorf("%s.pattern: %w", field, err))
+				}
+			default:
+				errs = append(errs, fmt.Errorf("%s.format: unknown format %q", field, p.Format))
+			}
+		case processorTypeJQ:
+			if _, err := compileTransform(p.Expr); err != nil {
+				errs = append(errs, fmt.Errorf("%s.expr: %w", field, err))
+			}
+			if p.Timeout < 0 {
+				errs = append(errs, fmt.Errorf("%s.timeout: must be positive", field))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s.type: unknown type %q", field, p.Type))
+		}
+	}
+	return errs
+}
+
+func validateFilter(field, include, exclude string) []error {
+	var errs []error
+	if include == "" && exclude == "" {
+		errs = append(errs, fmt.Errorf("%s: include or exclude is required", field))
+	}
+	if _, err := regexp.Compile(include); err != nil {
+		errs = append(errs, fmt.Errorf("%s.include: %w", field, err))
+	}
+	if _, err := regexp.Compile(exclude); err != nil {
+		errs = append(errs, fmt.Errorf("%s.exclude: %w", field, err))
+	}
+	return errs
+}
@@ -0,0 +1,147 @@
+package firetap_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/firetap"
+)
+
+func TestLoadConfigYAML(t *testing.T) {
+	t.Setenv("FIRETAP_TEST_STREAM", "my-stream")
+	cfg, err := firetap.LoadConfig(&firetap.Option{Config: "testdata/config.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Inputs.TagRecords {
+		t.Error("tag_records must be true")
+	}
+	if len(cfg.Outputs) != 2 {
+		t.Fatalf("unexpected outputs: %v", cfg.Outputs)
+	}
+	main := cfg.Outputs[0]
+	if main.Name != "main" || main.StreamName != "my-stream" || main.Batch.MaxRecords != 100 {
+		t.Errorf("unexpected output: %#v", main)
+	}
+	if time.Duration(main.Retry.MaxDelay) != 5*time.Second || time.Duration(main.Retry.MinDelay) != 100*time.Millisecond {
+		t.Errorf("unexpected retry: %#v", main.Retry)
+	}
+	errors := cfg.Outputs[1]
+	if errors.Name != "errors" || errors.Type != "kinesis" || errors.Filter.Include != "ERROR" {
+		t.Errorf("unexpected output: %#v", errors)
+	}
+	m := cfg.InvocationMetrics
+	if m.Format != "emf" || m.Namespace != "firetap" || time.Duration(m.Aggregate) != time.Minute || len(m.Percentiles) != 3 {
+		t.Errorf("unexpected invocation metrics: %#v", m)
+	}
+	if m.Output.Name != "metrics" || m.Output.Batch.MaxRecords == 0 {
+		t.Errorf("defaults must be set to the output of invocation metrics: %#v", m.Output)
+	}
+}
+
+func TestLoadConfigWrapper(t *testing.T) {
+	t.Setenv("FIRETAP_TEST_STREAM", "my-stream")
+	cfg, err := firetap.LoadConfig(&firetap.Option{Config: "testdata/config.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := cfg.Wrapper
+	if !w.StderrPassthrough || w.RuntimeProxy {
+		t.Errorf("unexpected wrapper: %#v", w)
+	}
+	if w.Buffer.MaxEvents != 100 || w.Buffer.MaxBytes != 16*1024*1024 || w.Buffer.DropPolicy != "drop_oldest" {
+		t.Errorf("defaults must be set to the buffer: %#v", w.Buffer)
+	}
+
+	cfg, err = firetap.LoadConfig(&firetap.Option{
+		Config:         "testdata/config.yaml",
+		RuntimeProxy:   true,
+		BufferMaxBytes: 1024,
+		DropPolicy:     "block",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = cfg.Wrapper
+	if !w.StderrPassthrough || !w.RuntimeProxy {
+		t.Errorf("flags must override the wrapper: %#v", w)
+	}
+	if w.Buffer.MaxEvents != 100 || w.Buffer.MaxBytes != 1024 || w.Buffer.DropPolicy != "block" {
+		t.Errorf("flags must override the buffer: %#v", w.Buffer)
+	}
+}
+
+func TestLoadConfigJsonnet(t *testing.T) {
+	t.Setenv("FIRETAP_TEST_STREAM", "my-stream")
+	opt := &firetap.Option{
+		Config:     "testdata/config.jsonnet",
+		StreamName: "overridden",
+		DeadLetter: "sqs://dlq",
+	}
+	cfg, err := firetap.LoadConfig(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Inputs.Buffering.TimeoutMs != 100 {
+		t.Errorf("unexpected buffering: %#v", cfg.Inputs.Buffering)
+	}
+	out := cfg.Outputs[0]
+	if out.StreamName != "overridden" || out.DeadLetter != "sqs://dlq" || out.Type != "kinesis" {
+		t.Errorf("flags must override the config: %#v", out)
+	}
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	cfg, err := firetap.LoadConfig(&firetap.Option{StreamName: "my-stream", DataStream: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Outputs) != 1 || cfg.Outputs[0].StreamName != "my-stream" || cfg.Outputs[0].Type != "kinesis" {
+		t.Errorf("unexpected outputs: %#v", cfg.Outputs)
+	}
+	if _, err := firetap.LoadConfig(&firetap.Option{}); err == nil {
+		t.Error("stream name must be required")
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	_, err := firetap.LoadConfig(&firetap.Option{Config: "testdata/invalid.json"})
+	if err == nil {
+		t.Fatal("must be invalid")
+	}
+	for _, s := range []string{
+		`inputs.types: unknown type "unknown"`,
+		`processors[0].include`,
+		`outputs[0].type: unknown type "sqs"`,
+		`outputs[0].stream_name: required`,
+		`invocation_metrics.format: unknown format "prometheus"`,
+		`invocation_metrics.aggregate: must be 1s or longer`,
+		`invocation_metrics.percentiles: must be in (0, 100]: 0`,
+		`invocation_metrics.output.stream_name: required`,
+		`traces.endpoint: invalid OTLP endpoint "localhost:4318"`,
+		`traces.timeout: must be positive`,
+		`wrapper.buffer: max_events and max_bytes must be positive`,
+		`wrapper.buffer.drop_policy: unknown policy "drop_all"`,
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error must contain %q: %s", s, err)
+		}
+	}
+}
+
+func TestLoadConfigStreamARN(t *testing.T) {
+	cfg, err := firetap.LoadConfig(&firetap.Option{
+		StreamName: "arn:aws:kinesis:ap-northeast-1:123456789012:stream/central-logs",
+		DataStream: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := cfg.Outputs[0]; out.Name != "central-logs" {
+		t.Errorf("unexpected name: %s", out.Name)
+	}
+	if _, err := firetap.LoadConfig(&firetap.Option{StreamName: "arn:aws:kinesis:ap-northeast-1:123456789012:table/foo"}); err == nil {
+		t.Error("must be invalid stream ARN")
+	}
+}
@@ -0,0 +1,76 @@
+package firetap
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const defaultRoleSessionName = "firetap"
+
+// destination represents a stream resolved from the stream name or ARN.
+type destination struct {
+	name   string
+	arn    string
+	region string
+}
+
+// parseDestination accepts a stream name or a stream ARN.
+//
+//	arn:aws:firehose:us-east-1:123456789012:deliverystream/name
+//	arn:aws:kinesis:us-east-1:123456789012:stream/name
+func parseDestination(s string) (destination, error) {
+	if !arn.IsARN(s) {
+		return destination{name: s}, nil
+	}
+	a, err := arn.Parse(s)
+	if err != nil {
+		return destination{}, fmt.Errorf("invalid stream ARN %s: %w", s, err)
+	}
+	resource, name, ok := strings.Cut(a.Resource, "/")
+	if !ok || (resource != "deliverystream" && resource != "stream") {
+		return destination{}, fmt.Errorf("invalid stream ARN %s: unexpected resource %s", s, a.Resource)
+	}
+	return destination{name: name, arn: s, region: a.Region}, nil
+}
+
+// loadAWSConfig loads the AWS config for the output.
+// When the role ARN is specified, the credentials are provided by assuming the role,
+// cached and refreshed automatically before they expire.
+func loadAWSConfig(ctx context.Context, cfg OutputConfig, dest destination) (aws.Config, error) {
+	opts := slices.Clone(cfg.awsOptions)
+	region := cfg.Region
+	if region == "" {
+		region = dest.region
+	}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if cfg.RoleARN == "" {
+		return awsCfg, nil
+	}
+	slog.InfoContext(ctx, "assuming role", "role_arn", cfg.RoleARN, "output", cfg.Name)
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), cfg.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = defaultRoleSessionName
+		if cfg.SessionName != "" {
+			o.RoleSessionName = cfg.SessionName
+		}
+		if cfg.ExternalID != "" {
+			o.ExternalID = aws.String(cfg.ExternalID)
+		}
+	})
+	awsCfg.Credentials = aws.NewCredentialsCache(provider)
+	return awsCfg, nil
+}
@@ -0,0 +1,215 @@
+package firetap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	sqsMaxBatchSize = 10
+	// sqsMaxBytes is the max size of a message and of the messages in a batch.
+	sqsMaxBytes = 256 * 1024
+)
+
+// DeadLetter is a destination for the records that failed to send permanently.
+type DeadLetter interface {
+	Put(ctx context.Context, entries []DeadLetterEntry) error
+}
+
+// DeadLetterEntry is a record that failed to send with the reason.
+type DeadLetterEntry struct {
+	Time       time.Time `json:"time"` // when the delivery failed
+	Stream     string    `json:"stream"`
+	Reason     string    `json:"reason"`
+	Record     string    `json:"record"`
+	RecordTime time.Time `json:"record_time"` // the time of the telemetry event of the record
+	// Truncated is true when the record is truncated to fit the destination (e.g. a SQS message).
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+func newDeadLetterEntries(stream string, records []Record, reason error) []DeadLetterEntry {
+	now := time.Now()
+	entries := make([]DeadLetterEntry, 0, len(records))
+	for _, r := range records {
+		entries = append(entries, DeadLetterEntry{
+			Time:       now,
+			Stream:     stream,
+			Reason:     reason.Error(),
+			Record:     string(r.Data),
+			RecordTime: r.Time,
+		})
+	}
+	return entries
+}
+
+// NewDeadLetter creates a DeadLetter from the URL.
+//
+//	file:///tmp/firetap-dead-letter.jsonl  appends to the local file
+//	s3://bucket/prefix/                     puts an object for each batch
+//	sqs://queue-name                        sends a message for each record
+func NewDeadLetter(ctx context.Context, awsCfg aws.Config, target string) (DeadLetter, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dead letter %s: %w", target, err)
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Host != "" || u.Path == "" {
+			return nil, fmt.Errorf("invalid dead letter %s: must be file:///absolute/path", target)
+		}
+		return &fileDeadLetter{path: u.Path}, nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid dead letter %s: bucket is required", target)
+		}
+		return &s3DeadLetter{
+			client: s3.NewFromConfig(awsCfg),
+			bucket: u.Host,
+			prefix: strings.TrimPrefix(u.Path, "/"),
+		}, nil
+	case "sqs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid dead letter %s: queue name is required", target)
+		}
+		client := sqs.NewFromConfig(awsCfg)
+		out, err := client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(u.Host)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get queue url of %s: %w", u.Host, err)
+		}
+		return &sqsDeadLetter{client: client, queueURL: *out.QueueUrl}, nil
+	default:
+		return nil, fmt.Errorf("unsupported dead letter scheme: %s", target)
+	}
+}
+
+type fileDeadLetter struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (d *fileDeadLetter) Put(ctx context.Context, entries []DeadLetterEntry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+type s3DeadLetter struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func (d *s3DeadLetter) Put(ctx context.Context, entries []DeadLetterEntry) error {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UTC()
+	key := path.Join(d.prefix, now.Format("2006/01/02"), now.Format("150405")+"-"+strconv.FormatInt(now.UnixNano(), 36)+".jsonl")
+	slog.DebugContext(ctx, "putting dead letter to s3", "bucket", d.bucket, "key", key, "records", len(entries))
+	_, err := d.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &d.bucket,
+		Key:    &key,
+		Body:   buf,
+	})
+	return err
+}
+
+type sqsDeadLetter struct {
+	client   *sqs.Client
+	queueURL string
+}
+
+func (d *sqsDeadLetter) Put(ctx context.Context, entries []DeadLetterEntry) error {
+	var msgs []sqsTypes.SendMessageBatchRequestEntry
+	var size int
+	for _, e := range entries {
+		b, err := marshalSQSMessage(e)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == sqsMaxBatchSize || size+len(b) > sqsMaxBytes {
+			if err := d.send(ctx, msgs); err != nil {
+				return err
+			}
+			msgs, size = msgs[:0], 0
+		}
+		msgs = append(msgs, sqsTypes.SendMessageBatchRequestEntry{
+			Id:          aws.String(strconv.Itoa(len(msgs))),
+			MessageBody: aws.String(string(b)),
+		})
+		size += len(b)
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return d.send(ctx, msgs)
+}
+
+func (d *sqsDeadLetter) send(ctx context.Context, msgs []sqsTypes.SendMessageBatchRequestEntry) error {
+	out, err := d.client.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
+		QueueUrl: &d.queueURL,
+		Entries:  msgs,
+	})
+	if err != nil {
+		return err
+	}
+	if len(out.Failed) > 0 {
+		return fmt.Errorf("failed to send %d messages to sqs: %s", len(out.Failed), aws.ToString(out.Failed[0].Message))
+	}
+	return nil
+}
+
+// marshalSQSMessage marshals the entry into a message body within sqsMaxBytes.
+// The record too large for a message is truncated at a UTF-8 boundary.
+func marshalSQSMessage(e DeadLetterEntry) ([]byte, error) {
+	for {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		excess := len(b) - sqsMaxBytes
+		if excess <= 0 {
+			return b, nil
+		}
+		if e.Record == "" {
+			return nil, fmt.Errorf("dead letter entry is too large for sqs: %d bytes", len(b))
+		}
+		// the escaped record may be longer than the record, so cut at least the excess
+		cut := max(len(e.Record)-excess, 0)
+		for cut > 0 && !utf8.RuneStart(e.Record[cut]) {
+			cut--
+		}
+		e.Record, e.Truncated = e.Record[:cut], true
+	}
+}
@@ -0,0 +1,195 @@
+package firetap_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/fujiwara/firetap"
+)
+
+func TestFileDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	dl, err := firetap.NewDeadLetter(ctx, aws.Config{}, "file://"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC)
+	for _, entries := range [][]firetap.DeadLetterEntry{
+		{
+			{Time: ts, Stream: "s", Reason: "failed", Record: "foo\n"},
+			{Time: ts, Stream: "s", Reason: "failed", Record: `{"bar":1}` + "\n"},
+		},
+		{
+			{Time: ts.Add(time.Second), Stream: "s", Reason: "circuit is open", Record: "baz\n", RecordTime: ts.Add(-time.Minute)},
+		},
+	} {
+		if err := dl.Put(ctx, entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// replay by send --format dead_letter
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sender := &testLogSender{}
+	n, err := firetap.SendFrom(sender, f, "dead_letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || sender.String() != "foo\n"+`{"bar":1}`+"\nbaz\n" {
+		t.Errorf("unexpected records: %d %q", n, sender.String())
+	}
+	if !sender.records[2].Time.Equal(ts.Add(-time.Minute)) {
+		t.Errorf("the time of the record must be replayed: %s", sender.records[2].Time)
+	}
+}
+
+func TestNewDeadLetter(t *testing.T) {
+	sqsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct{ QueueName string }
+		json.NewDecoder(r.Body).Decode(&in)
+		if r.Header.Get("X-Amz-Target") != "AmazonSQS.GetQueueUrl" || in.QueueName != "dlq" {
+			w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.sqs#QueueDoesNotExist","message":"not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		json.NewEncoder(w).Encode(map[string]string{"QueueUrl": "https://sqs.us-east-1.amazonaws.com/123456789012/dlq"})
+	}))
+	defer sqsServer.Close()
+	awsCfg := aws.Config{
+		Region:           "us-east-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("dummy", "dummy", ""),
+		BaseEndpoint:     aws.String(sqsServer.URL),
+		RetryMaxAttempts: 1,
+	}
+
+	for _, tc := range []struct {
+		target string
+		want   string // empty means an error
+	}{
+		{target: "file:///tmp/firetap-dead-letter.jsonl", want: "file /tmp/firetap-dead-letter.jsonl"},
+		{target: "s3://bucket/prefix/", want: "s3 bucket prefix/"},
+		{target: "s3://bucket", want: "s3 bucket "},
+		{target: "sqs://dlq", want: "sqs https://sqs.us-east-1.amazonaws.com/123456789012/dlq"},
+		{target: "file://relative/path"},
+		{target: "file://"},
+		{target: "s3:///prefix/"},
+		{target: "sqs://"},
+		{target: "sqs://unknown"},
+		{target: "ftp://host/path"},
+		{target: "/tmp/dead-letter.jsonl"},
+		{target: "%%invalid"},
+	} {
+		dl, err := firetap.NewDeadLetter(context.Background(), awsCfg, tc.target)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: error expected", tc.target)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.target, err)
+			continue
+		}
+		if got := firetap.DeadLetterTarget(dl); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestFileDeadLetterError(t *testing.T) {
+	dl, err := firetap.NewDeadLetter(context.Background(), aws.Config{}, "file://"+filepath.Join(t.TempDir(), "no-such-dir", "dl.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dl.Put(context.Background(), []firetap.DeadLetterEntry{{Record: "foo\n"}})
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSQSDeadLetter(t *testing.T) {
+	var batches [][]firetap.DeadLetterEntry
+	sqsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonSQS.GetQueueUrl":
+			w.Write([]byte(`{"QueueUrl":"https://sqs.us-east-1.amazonaws.com/123456789012/dlq"}`))
+		case "AmazonSQS.SendMessageBatch":
+			var in struct {
+				Entries []struct{ MessageBody string }
+			}
+			json.NewDecoder(r.Body).Decode(&in)
+			var size int
+			var batch []firetap.DeadLetterEntry
+			for _, e := range in.Entries {
+				size += len(e.MessageBody)
+				var entry firetap.DeadLetterEntry
+				if err := json.Unmarshal([]byte(e.MessageBody), &entry); err != nil {
+					t.Error(err)
+				}
+				batch = append(batch, entry)
+			}
+			if len(in.Entries) > 10 || size > 256*1024 {
+				t.Errorf("batch exceeds the limits of sqs: %d messages, %d bytes", len(in.Entries), size)
+			}
+			batches = append(batches, batch)
+			w.Write([]byte(`{"Successful":[],"Failed":[]}`))
+		}
+	}))
+	defer sqsServer.Close()
+	awsCfg := aws.Config{
+		Region:           "us-east-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("dummy", "dummy", ""),
+		BaseEndpoint:     aws.String(sqsServer.URL),
+		RetryMaxAttempts: 1,
+	}
+	dl, err := firetap.NewDeadLetter(context.Background(), awsCfg, "sqs://dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []firetap.DeadLetterEntry
+	for i := 0; i < 12; i++ {
+		entries = append(entries, firetap.DeadLetterEntry{Stream: "s", Reason: "failed", Record: strings.Repeat("x", 50*1024) + "\n"})
+	}
+	// too large for a message, and longer when escaped
+	huge := strings.Repeat("\"é", 100*1024) + "\n"
+	entries = append(entries, firetap.DeadLetterEntry{Stream: "s", Reason: "failed", Record: huge})
+	if err := dl.Put(context.Background(), entries); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []firetap.DeadLetterEntry
+	for _, b := range batches {
+		got = append(got, b...)
+	}
+	if len(got) != len(entries) || len(batches) < 3 {
+		t.Fatalf("unexpected messages: %d in %d batches", len(got), len(batches))
+	}
+	for i, e := range got[:12] {
+		if e.Record != entries[i].Record || e.Truncated {
+			t.Errorf("%d: the record must not be truncated", i)
+		}
+	}
+	last := got[12]
+	if !last.Truncated || len(last.Record) == 0 || !strings.HasPrefix(huge, last.Record) || !utf8.ValidString(last.Record) {
+		t.Errorf("the large record must be truncated at a UTF-8 boundary: truncated=%v len=%d", last.Truncated, len(last.Record))
+	}
+}
@@ -0,0 +1,166 @@
+package firetap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	formatRaw            = "raw"
+	formatCloudWatchLogs = "cloudwatch_logs"
+
+	// maxEnvelopeMessageBytes is the max size of the messages in a CloudWatch Logs envelope.
+	// The compressed envelope must be smaller than the max record size (1MB).
+	maxEnvelopeMessageBytes = 256 * 1024
+)
+
+// encoder encodes the records of a batch into the payloads put to the stream.
+// groups[i] holds the records encoded in payloads[i].
+type encoder interface {
+	encode(records []Record) (payloads [][]byte, groups [][]Record, err error)
+}
+
+func newEncoder(ctx context.Context, cfg OutputConfig) (encoder, error) {
+	switch cfg.Format {
+	case formatCloudWatchLogs:
+		return newCloudWatchLogsEncoder(ctx, cfg.CloudWatchLogs)
+	default:
+		return rawEncoder{}, nil
+	}
+}
+
+// rawEncoder puts each record as is.
+type rawEncoder struct{}
+
+func (rawEncoder) encode(records []Record) ([][]byte, [][]Record, error) {
+	payloads := make([][]byte, 0, len(records))
+	groups := make([][]Record, 0, len(records))
+	for i := range records {
+		payloads = append(payloads, records[i].Data)
+		groups = append(groups, records[i:i+1])
+	}
+	return payloads, groups, nil
+}
+
+// CloudWatchLogsEnvelope is the payload of CloudWatch Logs subscription filters.
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/logs/SubscriptionFilters.html
+type CloudWatchLogsEnvelope struct {
+	MessageType         string               `json:"messageType"`
+	Owner               string               `json:"owner"`
+	LogGroup            string               `json:"logGroup"`
+	LogStream           string               `json:"logStream"`
+	SubscriptionFilters []string             `json:"subscriptionFilters"`
+	LogEvents           []CloudWatchLogEvent `json:"logEvents"`
+}
+
+type CloudWatchLogEvent struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// cloudWatchLogsEncoder encodes the records into gzipped CloudWatch Logs subscription envelopes,
+// so the consumers of CloudWatch Logs subscriptions can read them without changes.
+type cloudWatchLogsEncoder struct {
+	owner     string
+	logGroup  string
+	logStream string
+	seq       atomic.Int64
+}
+
+func newCloudWatchLogsEncoder(ctx context.Context, cfg *CloudWatchLogsConfig) (*cloudWatchLogsEncoder, error) {
+	e := &cloudWatchLogsEncoder{
+		logGroup:  os.Getenv("AWS_LAMBDA_LOG_GROUP_NAME"),
+		logStream: os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME"),
+	}
+	if cfg != nil {
+		e.owner = cfg.Owner
+		if cfg.LogGroup != "" {
+			e.logGroup = cfg.LogGroup
+		}
+		if cfg.LogStream != "" {
+			e.logStream = cfg.LogStream
+		}
+	}
+	if e.owner == "" {
+		// the owner is the account of the function
+		awsCfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		out, err := sts.NewFromConfig(awsCfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the account ID for the envelope owner: %w", err)
+		}
+		e.owner = aws.ToString(out.Account)
+	}
+	return e, nil
+}
+
+func (e *cloudWatchLogsEncoder) encode(records []Record) ([][]byte, [][]Record, error) {
+	var payloads [][]byte
+	var groups [][]Record
+	var start, size int
+	for i := range records {
+		if size += len(records[i].Data); size > maxEnvelopeMessageBytes && i > start {
+			p, err := e.envelope(records[start:i])
+			if err != nil {
+				return nil, nil, err
+			}
+			payloads = append(payloads, p)
+			groups = append(groups, records[start:i])
+			start, size = i, len(records[i].Data)
+		}
+	}
+	if start < len(records) {
+		p, err := e.envelope(records[start:])
+		if err != nil {
+			return nil, nil, err
+		}
+		payloads = append(payloads, p)
+		groups = append(groups, records[start:])
+	}
+	return payloads, groups, nil
+}
+
+func (e *cloudWatchLogsEncoder) envelope(records []Record) ([]byte, error) {
+	env := CloudWatchLogsEnvelope{
+		MessageType:         "DATA_MESSAGE",
+		Owner:               e.owner,
+		LogGroup:            e.logGroup,
+		LogStream:           e.logStream,
+		SubscriptionFilters: []string{"firetap"},
+		LogEvents:           make([]CloudWatchLogEvent, 0, len(records)),
+	}
+	for _, r := range records {
+		ts := r.Time.UnixMilli()
+		env.LogEvents = append(env.LogEvents, CloudWatchLogEvent{
+			ID:        e.eventID(ts),
+			Timestamp: ts,
+			Message:   string(bytes.TrimSuffix(r.Data, []byte("\n"))),
+		})
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if err := json.NewEncoder(zw).Encode(env); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// eventID returns a numeric string unique in the sandbox like the IDs of CloudWatch Logs.
+func (e *cloudWatchLogsEncoder) eventID(ts int64) string {
+	return fmt.Sprintf("%d%020d", ts, e.seq.Add(1))
+}
@@ -1,5 +1,120 @@
 package firetap
 
-var (
-	HandleTelemetry = handleTelemetry
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/shogo82148/go-retry"
 )
+
+func HandleTelemetry(sender Sender, tagRecords bool) http.HandlerFunc {
+	r := &Receiver{TagRecords: tagRecords}
+	return r.handleTelemetry(sender)
+}
+
+func (e *MetricsEmitter) SetWriter(w io.Writer) {
+	e.w = w
+}
+
+func (e *MetricsEmitter) Emit(ctx context.Context) {
+	e.emit(ctx)
+}
+
+// DeadLetterTarget describes the destination of the dead letter.
+func DeadLetterTarget(dl DeadLetter) string {
+	switch d := dl.(type) {
+	case *fileDeadLetter:
+		return "file " + d.path
+	case *s3DeadLetter:
+		return "s3 " + d.bucket + " " + d.prefix
+	case *sqsDeadLetter:
+		return "sqs " + d.queueURL
+	}
+	return ""
+}
+
+func NewShutdownPlan(now, deadline time.Time) (drainUntil, receiverUntil, flushUntil time.Time) {
+	p := newShutdownPlan(now, deadline)
+	return p.drainUntil, p.receiverUntil, p.flushUntil
+}
+
+func EncodeCloudWatchLogs(records []Record, cfg *CloudWatchLogsConfig) ([][]byte, error) {
+	e, err := newCloudWatchLogsEncoder(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	payloads, _, err := e.encode(records)
+	return payloads, err
+}
+
+func SetDeadLetter(s *LogSender, dl DeadLetter) {
+	s.deadLetter = dl
+}
+
+// failingEncoder fails to encode any records.
+type failingEncoder struct {
+	err error
+}
+
+func (e failingEncoder) encode([]Record) ([][]byte, [][]Record, error) {
+	return nil, nil, e.err
+}
+
+func SetEncodeError(s *LogSender, err error) {
+	s.encoder = failingEncoder{err: err}
+}
+
+func SendFrom(sender Sender, r io.Reader, format string) (int, error) {
+	return sendFrom(context.Background(), &Receiver{}, sender, r, format)
+}
+
+func NewTailer(client *kinesis.Client, stream string, from time.Time, requestID, level string, w io.Writer) *Tailer {
+	return &Tailer{
+		client:       client,
+		stream:       stream,
+		from:         from,
+		filter:       newTailFilter(requestID, level),
+		pollInterval: 10 * time.Millisecond,
+		readInterval: 10 * time.Millisecond,
+		retryPolicy:  retry.Policy{MinDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond},
+		w:            w,
+	}
+}
+
+func ValidateTo(opt *Option, w io.Writer) error {
+	return validate(context.Background(), opt, w)
+}
+
+var BenchEvents = benchEvents
+
+func BenchTo(opt *Option, w io.Writer) error {
+	return bench(context.Background(), opt, w)
+}
+
+func AppendRecord(dst, raw []byte) ([]byte, error) {
+	return appendRecord(dst, raw)
+}
+
+func AppendJSONString(dst []byte, s string) []byte {
+	return appendJSONString(dst, s)
+}
+
+func (m *InvocationMetrics) SetWriter(w io.Writer) {
+	m.w = w
+}
+
+func (m *InvocationMetrics) EmitClosed(ctx context.Context, now time.Time) {
+	m.emitClosed(ctx, now)
+}
+
+func (e *SpanExporter) Flush(ctx context.Context) error {
+	return e.flush(ctx)
+}
+
+func ParseTracing(typ, value string) (traceID, spanID string, sampled, ok bool) {
+	tc, ok := parseTracing(typ, value)
+	return tc.TraceID, tc.SpanID, tc.Sampled, ok
+}
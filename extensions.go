@@ -9,7 +9,9 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	slogcontext "github.com/PumpkinSeed/slog-context"
 )
@@ -18,6 +20,9 @@ type ExtensionClient struct {
 	extensionId string
 	client      *http.Client
 	skip        bool
+
+	// OnInvoke is called on each INVOKE event. The extension registers INVOKE events only when it is set.
+	OnInvoke func(ctx context.Context, ev *ExtensionEvent)
 }
 
 func NewExtensionClient(ctx context.Context) *ExtensionClient {
@@ -41,7 +46,11 @@ func (c *ExtensionClient) Register(ctx context.Context) error {
 		return nil
 	}
 	registerURL := fmt.Sprintf("%s/register", lambdaExtensionAPIEndpoint)
-	req, _ := http.NewRequestWithContext(ctx, "POST", registerURL, strings.NewReader(`{"events":["SHUTDOWN"]}`))
+	events := `{"events":["SHUTDOWN"]}`
+	if c.OnInvoke != nil {
+		events = `{"events":["INVOKE","SHUTDOWN"]}`
+	}
+	req, _ := http.NewRequestWithContext(ctx, "POST", registerURL, strings.NewReader(events))
 	req.Header.Set(lambdaExtensionNameHeader, lambdaExtensionName)
 	slog.InfoContext(ctx, "registering extension", "url", registerURL, "name", lambdaExtensionName, "headers", req.Header)
 
@@ -65,28 +74,48 @@ func (c *ExtensionClient) Register(ctx context.Context) error {
 	return nil
 }
 
-func (c *ExtensionClient) fetchNextEvent(ctx context.Context) (string, error) {
+// ExtensionEvent represents an event of the Extensions API.
+// https://docs.aws.amazon.com/lambda/latest/dg/runtimes-extensions-api.html#extensions-api-next
+type ExtensionEvent struct {
+	EventType          string `json:"eventType"`
+	DeadlineMs         int64  `json:"deadlineMs"`
+	RequestID          string `json:"requestId,omitempty"`
+	InvokedFunctionArn string `json:"invokedFunctionArn,omitempty"`
+	ShutdownReason     string `json:"shutdownReason,omitempty"`
+	Tracing            struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"tracing"`
+}
+
+// Deadline returns the deadline of the event.
+func (e *ExtensionEvent) Deadline() time.Time {
+	return time.UnixMilli(e.DeadlineMs)
+}
+
+func (c *ExtensionClient) fetchNextEvent(ctx context.Context) (*ExtensionEvent, error) {
 	u := fmt.Sprintf("%s/event/next", lambdaExtensionAPIEndpoint)
 	slog.DebugContext(ctx, "getting next event", "url", u, "extension_id", c.extensionId)
 	req, _ := http.NewRequestWithContext(ctx, "GET", u, nil)
 	req.Header.Set(lambdaExtensionIdentifierHeader, c.extensionId)
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to get next event: %v", err)
+		return nil, fmt.Errorf("failed to get next event: %v", err)
 	}
 	defer resp.Body.Close()
-	var event map[string]interface{}
+	var event ExtensionEvent
 	if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
-		return "", fmt.Errorf("failed to decode event: %v", err)
+		return nil, fmt.Errorf("failed to decode event: %v", err)
 	}
 	slog.DebugContext(ctx, "event received", "event", event)
-	if ev, ok := event["eventType"].(string); ok {
-		return ev, nil
+	if event.EventType == "" {
+		return nil, fmt.Errorf("eventType not found: %v", event)
 	}
-	return "", fmt.Errorf("eventType not found: %v", event)
+	return &event, nil
 }
 
-func (c *ExtensionClient) Run(ctx context.Context, cancel func()) error {
+// Run waits for the events. When the SHUTDOWN event is received, it calls shutdown and returns.
+func (c *ExtensionClient) Run(ctx context.Context, shutdown func(*ExtensionEvent)) error {
 	ctx = slogcontext.WithValue(ctx, "component", "extension-client")
 	if c.skip {
 		slog.InfoContext(ctx, "skipping extension running")
@@ -98,18 +127,21 @@ func (c *ExtensionClient) Run(ctx context.Context, cancel func()) error {
 		if err != nil {
 			return err
 		}
-		switch ev {
+		switch ev.EventType {
 		case "INVOKE":
-			slog.DebugContext(ctx, "invoke event received")
+			slog.DebugContext(ctx, "invoke event received", "request_id", ev.RequestID)
+			if c.OnInvoke != nil {
+				c.OnInvoke(ctx, ev)
+			}
 		case "SHUTDOWN":
-			slog.DebugContext(ctx, "shutdown event received. shutting down extension")
-			cancel()
+			slog.DebugContext(ctx, "shutdown event received. shutting down extension", "reason", ev.ShutdownReason, "deadline", ev.Deadline())
+			shutdown(ev)
 			return nil
 		}
 	}
 }
 
-func (c *ExtensionClient) SubscribeTelemetry(ctx context.Context, endpoint string) error {
+func (c *ExtensionClient) SubscribeTelemetry(ctx context.Context, endpoint string, input InputConfig) error {
 	ctx = slogcontext.WithValue(ctx, "component", "extension-client")
 	if c.skip {
 		slog.InfoContext(ctx, "skipping extension subscription to telemetry")
@@ -117,6 +149,22 @@ func (c *ExtensionClient) SubscribeTelemetry(ctx context.Context, endpoint strin
 	}
 	u := lambdaTelemetryAPIEndpoint
 	payload := NewTelemetrySubscription(endpoint)
+	for _, t := range input.Types {
+		if !slices.Contains(payload.Types, t) {
+			payload.Types = append(payload.Types, t)
+		}
+	}
+	if b := input.Buffering; b != nil {
+		if b.MaxItems > 0 {
+			payload.Buffering.MaxItems = b.MaxItems
+		}
+		if b.MaxBytes > 0 {
+			payload.Buffering.MaxBytes = b.MaxBytes
+		}
+		if b.TimeoutMs > 0 {
+			payload.Buffering.TimeoutMs = b.TimeoutMs
+		}
+	}
 	jsonPayload, _ := json.Marshal(payload)
 	req, _ := http.NewRequestWithContext(ctx, "PUT", u, bytes.NewReader(jsonPayload))
 	req.Header.Set(lambdaExtensionNameHeader, lambdaExtensionName)
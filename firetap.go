@@ -34,33 +34,75 @@ func Run(ctx context.Context, opt *Option) error {
 
 	slog.InfoContext(ctx, "running firetap", "option", opt)
 
-	rcv, err := NewReceiver(ctx)
+	cfg, err := LoadConfig(opt)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to load config", "error", err)
+		return err
+	}
+	slog.InfoContext(ctx, "pipeline configured", "config", cfg)
+
+	rcv, err := NewReceiver(ctx, opt, cfg)
 	if err != nil {
 		slog.ErrorContext(ctx, "failed to start receiver", "error", err)
 		return err
 	}
 
+	if cfg.InvocationMetrics != nil {
+		if rcv.InvocationMetrics, err = NewInvocationMetrics(ctx, cfg.InvocationMetrics); err != nil {
+			slog.ErrorContext(ctx, "failed to start invocation metrics", "error", err)
+			return err
+		}
+	}
+	if cfg.Traces != nil {
+		if rcv.Spans, err = NewSpanExporter(cfg.Traces); err != nil {
+			slog.ErrorContext(ctx, "failed to start span exporter", "error", err)
+			return err
+		}
+	}
+
+	sender, err := NewPipeline(ctx, cfg)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to start sender", "error", err)
+		return err
+	}
+
 	ext := NewExtensionClient(ctx)
+	var reloader *Reloader
+	if opt.ReloadSource != "" {
+		source, err := NewConfigSource(ctx, opt.ReloadSource)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to create config source", "error", err)
+			return err
+		}
+		reloader = NewReloader(source, sender, opt.ReloadInterval)
+	}
+	if reloader != nil || rcv.tracksTraces() {
+		ext.OnInvoke = func(ctx context.Context, ev *ExtensionEvent) {
+			rcv.ObserveInvoke(ev)
+			if reloader != nil {
+				reloader.Poll(ctx)
+			}
+		}
+	}
 	if err := ext.Register(ctx); err != nil {
 		slog.ErrorContext(ctx, "failed to register extension", "error", err)
 		return err
 	}
-	if err := ext.SubscribeTelemetry(ctx, rcv.Endpoint); err != nil {
+	if err := ext.SubscribeTelemetry(ctx, rcv.Endpoint, cfg.Inputs); err != nil {
 		slog.ErrorContext(ctx, "failed to subscribe telemetry", "error", err)
 		return err
 	}
 
-	sender, err := NewSender(ctx, opt.StreamName, opt.DataStream)
-	if err != nil {
-		slog.ErrorContext(ctx, "failed to start sender", "error", err)
-		return err
-	}
+	emitter := NewMetricsEmitter(opt, sender)
 
 	var wg sync.WaitGroup
 	wg.Add(3)
 	go func() {
 		defer wg.Done()
-		err := ext.Run(ctx, cancel)
+		err := ext.Run(ctx, func(ev *ExtensionEvent) {
+			gracefulShutdown(ctx, ev, rcv, sender, emitter)
+			cancel()
+		})
 		if err != nil {
 			slog.ErrorContext(ctx, "failed to run extension client", "error", err)
 		}
@@ -72,6 +114,24 @@ func Run(ctx context.Context, opt *Option) error {
 			slog.ErrorContext(ctx, "failed to run receiver", "error", err)
 		}
 	}()
+	go func() {
+		defer wg.Done()
+		emitter.Run(ctx)
+	}()
+	if m := rcv.InvocationMetrics; m != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Run(ctx)
+		}()
+	}
+	if e := rcv.Spans; e != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.Run(ctx)
+		}()
+	}
 	wg.Wait()
 	return nil
 }
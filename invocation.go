@@ -0,0 +1,405 @@
+package firetap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	slogcontext "github.com/PumpkinSeed/slog-context"
+)
+
+const (
+	invocationMetricsFormatEMF    = "emf"
+	invocationMetricsFormatRecord = "record"
+
+	defaultInvocationMetricsNamespace = "firetap"
+)
+
+var defaultInvocationMetricsPercentiles = []float64{50, 90, 99}
+
+// platformReport is the record of the platform.report event.
+// https://docs.aws.amazon.com/lambda/latest/dg/telemetry-schema-reference.html#platform-report
+type platformReport struct {
+	RequestID string `json:"requestId"`
+	Status    string `json:"status"`
+	Metrics   struct {
+		DurationMs        float64  `json:"durationMs"`
+		BilledDurationMs  float64  `json:"billedDurationMs"`
+		MemorySizeMB      float64  `json:"memorySizeMB"`
+		MaxMemoryUsedMB   float64  `json:"maxMemoryUsedMB"`
+		InitDurationMs    *float64 `json:"initDurationMs,omitempty"`
+		RestoreDurationMs *float64 `json:"restoreDurationMs,omitempty"`
+	} `json:"metrics"`
+}
+
+// coldStart reports whether the invocation is the first one after the initialization (or the restoration of SnapStart).
+// The durations are reported only for the cold starts.
+func (r *platformReport) coldStart() bool {
+	return r.Metrics.InitDurationMs != nil || r.Metrics.RestoreDurationMs != nil
+}
+
+// InvocationRecord is the metric record of an invocation.
+type InvocationRecord struct {
+	Type              string   `json:"type"` // "invocation"
+	Time              string   `json:"time"`
+	FunctionName      string   `json:"functionName"`
+	FunctionVersion   string   `json:"functionVersion,omitempty"`
+	RequestID         string   `json:"requestId"`
+	Status            string   `json:"status"`
+	ColdStart         bool     `json:"coldStart"`
+	DurationMs        float64  `json:"durationMs"`
+	BilledDurationMs  float64  `json:"billedDurationMs"`
+	MemorySizeMB      float64  `json:"memorySizeMB"`
+	MaxMemoryUsedMB   float64  `json:"maxMemoryUsedMB"`
+	InitDurationMs    *float64 `json:"initDurationMs,omitempty"`
+	RestoreDurationMs *float64 `json:"restoreDurationMs,omitempty"`
+}
+
+// InvocationSummary is the metric record of the invocations aggregated in a period.
+// The stats have the percentiles like "p99", "max" and "avg".
+type InvocationSummary struct {
+	Type              string             `json:"type"` // "invocation_summary"
+	Time              string             `json:"time"` // start of the period
+	PeriodSeconds     float64            `json:"periodSeconds"`
+	FunctionName      string             `json:"functionName"`
+	FunctionVersion   string             `json:"functionVersion,omitempty"`
+	Invocations       int                `json:"invocations"`
+	ColdStarts        int                `json:"coldStarts"`
+	Errors            int                `json:"errors"`
+	BilledDurationMs  float64            `json:"billedDurationMs"` // sum
+	DurationMs        map[string]float64 `json:"durationMs"`
+	MaxMemoryUsedMB   map[string]float64 `json:"maxMemoryUsedMB"`
+	InitDurationMs    map[string]float64 `json:"initDurationMs,omitempty"`
+	RestoreDurationMs map[string]float64 `json:"restoreDurationMs,omitempty"`
+}
+
+// invocationWindow accumulates the invocations in a period.
+type invocationWindow struct {
+	start            time.Time
+	invocations      int
+	coldStarts       int
+	errors           int
+	billedDurationMs float64
+	durations        []float64
+	memories         []float64
+	inits            []float64
+	restores         []float64
+}
+
+func (w *invocationWindow) add(r *platformReport) {
+	w.invocations++
+	if r.coldStart() {
+		w.coldStarts++
+	}
+	if r.Status != "success" {
+		w.errors++
+	}
+	w.billedDurationMs += r.Metrics.BilledDurationMs
+	w.durations = append(w.durations, r.Metrics.DurationMs)
+	w.memories = append(w.memories, r.Metrics.MaxMemoryUsedMB)
+	if v := r.Metrics.InitDurationMs; v != nil {
+		w.inits = append(w.inits, *v)
+	}
+	if v := r.Metrics.RestoreDurationMs; v != nil {
+		w.restores = append(w.restores, *v)
+	}
+}
+
+// InvocationMetrics emits the metrics of the invocations derived from the platform.report events,
+// for each invocation or aggregated in the period.
+type InvocationMetrics struct {
+	format          string
+	namespace       string
+	aggregate       time.Duration
+	percentiles     []float64
+	functionName    string
+	functionVersion string
+	w               io.Writer
+	sender          Sender
+
+	mu     sync.Mutex
+	window *invocationWindow
+}
+
+// NewInvocationMetrics creates an InvocationMetrics. The metrics are sent to the output of the config,
+// or written to stdout without the output.
+func NewInvocationMetrics(ctx context.Context, cfg *InvocationMetricsConfig) (*InvocationMetrics, error) {
+	m := &InvocationMetrics{
+		format:          cfg.Format,
+		namespace:       cfg.Namespace,
+		aggregate:       time.Duration(cfg.Aggregate),
+		percentiles:     cfg.Percentiles,
+		functionName:    os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+		functionVersion: os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+		w:               os.Stdout,
+	}
+	if cfg.Output != nil {
+		sender, err := NewSender(ctx, *cfg.Output)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the sender of invocation metrics: %w", err)
+		}
+		m.sender = sender
+	}
+	return m, nil
+}
+
+// Run emits the aggregated window when the period ends until ctx is done.
+// The window left is emitted by Close.
+func (m *InvocationMetrics) Run(ctx context.Context) {
+	if m.aggregate <= 0 {
+		return
+	}
+	ctx = slogcontext.WithValue(ctx, "component", "invocation-metrics")
+	for {
+		next := time.Now().Truncate(m.aggregate).Add(m.aggregate)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case now := <-timer.C:
+			m.emitClosed(ctx, now)
+		}
+	}
+}
+
+// emitClosed emits the window of which the period has ended at now, and flushes the output.
+func (m *InvocationMetrics) emitClosed(ctx context.Context, now time.Time) {
+	m.mu.Lock()
+	closed := m.window != nil && !m.window.start.Add(m.aggregate).After(now)
+	if closed {
+		m.emitWindow(ctx)
+	}
+	m.mu.Unlock()
+	if !closed {
+		return
+	}
+	if err := m.flush(ctx); err != nil {
+		slog.WarnContext(ctx, "failed to flush invocation metrics", "error", err)
+	}
+}
+
+// observe emits the metrics of the platform.report event, or adds them to the window.
+// The window is emitted by Run when the period ends, with the first invocation after the period, or by Close.
+func (m *InvocationMetrics) observe(ctx context.Context, ts time.Time, record []byte) {
+	ctx = slogcontext.WithValue(ctx, "component", "invocation-metrics")
+	var r platformReport
+	if err := json.Unmarshal(record, &r); err != nil {
+		slog.WarnContext(ctx, "failed to decode platform.report", "error", err)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.aggregate <= 0 {
+		m.write(ctx, ts, m.invocation(ts, &r))
+		return
+	}
+	start := ts.Truncate(m.aggregate)
+	if m.window != nil && !m.window.start.Equal(start) {
+		m.emitWindow(ctx)
+	}
+	if m.window == nil {
+		m.window = &invocationWindow{start: start}
+	}
+	m.window.add(&r)
+}
+
+// flush flushes the metrics buffered by the output.
+func (m *InvocationMetrics) flush(ctx context.Context) error {
+	if m.sender == nil {
+		return nil
+	}
+	return m.sender.Flush(ctx)
+}
+
+// Close emits the current window and flushes the output.
+func (m *InvocationMetrics) Close(ctx context.Context) error {
+	ctx = slogcontext.WithValue(ctx, "component", "invocation-metrics")
+	m.mu.Lock()
+	if m.window != nil {
+		m.emitWindow(ctx)
+	}
+	m.mu.Unlock()
+	return m.flush(ctx)
+}
+
+func (m *InvocationMetrics) emitWindow(ctx context.Context) {
+	w := m.window
+	m.window = nil
+	m.write(ctx, w.start, m.summary(w))
+}
+
+func (m *InvocationMetrics) write(ctx context.Context, ts time.Time, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to marshal invocation metrics", "error", err)
+		return
+	}
+	b = append(b, '\n')
+	if m.sender != nil {
+		if err := m.sender.Send(ctx, Record{Time: ts, Data: b}); err != nil {
+			slog.WarnContext(ctx, "failed to send invocation metrics", "error", err)
+		}
+		return
+	}
+	if _, err := m.w.Write(b); err != nil {
+		slog.WarnContext(ctx, "failed to write invocation metrics", "error", err)
+	}
+}
+
+func (m *InvocationMetrics) invocation(ts time.Time, r *platformReport) any {
+	if m.format == invocationMetricsFormatRecord {
+		return &InvocationRecord{
+			Type:              "invocation",
+			Time:              ts.UTC().Format(time.RFC3339Nano),
+			FunctionName:      m.functionName,
+			FunctionVersion:   m.functionVersion,
+			RequestID:         r.RequestID,
+			Status:            r.Status,
+			ColdStart:         r.coldStart(),
+			DurationMs:        r.Metrics.DurationMs,
+			BilledDurationMs:  r.Metrics.BilledDurationMs,
+			MemorySizeMB:      r.Metrics.MemorySizeMB,
+			MaxMemoryUsedMB:   r.Metrics.MaxMemoryUsedMB,
+			InitDurationMs:    r.Metrics.InitDurationMs,
+			RestoreDurationMs: r.Metrics.RestoreDurationMs,
+		}
+	}
+	values := []emfValue{
+		{"Duration", "Milliseconds", r.Metrics.DurationMs},
+		{"BilledDuration", "Milliseconds", r.Metrics.BilledDurationMs},
+		{"MaxMemoryUsed", "Megabytes", r.Metrics.MaxMemoryUsedMB},
+		{"ColdStart", "Count", boolCount(r.coldStart())},
+		{"Errors", "Count", boolCount(r.Status != "success")},
+	}
+	if v := r.Metrics.InitDurationMs; v != nil {
+		values = append(values, emfValue{"InitDuration", "Milliseconds", *v})
+	}
+	if v := r.Metrics.RestoreDurationMs; v != nil {
+		values = append(values, emfValue{"RestoreDuration", "Milliseconds", *v})
+	}
+	doc := m.document(ts, values)
+	doc["requestId"] = r.RequestID
+	doc["status"] = r.Status
+	return doc
+}
+
+func (m *InvocationMetrics) summary(w *invocationWindow) any {
+	if m.format == invocationMetricsFormatRecord {
+		s := &InvocationSummary{
+			Type:             "invocation_summary",
+			Time:             w.start.UTC().Format(time.RFC3339Nano),
+			PeriodSeconds:    m.aggregate.Seconds(),
+			FunctionName:     m.functionName,
+			FunctionVersion:  m.functionVersion,
+			Invocations:      w.invocations,
+			ColdStarts:       w.coldStarts,
+			Errors:           w.errors,
+			BilledDurationMs: w.billedDurationMs,
+			DurationMs:       m.stats(w.durations),
+			MaxMemoryUsedMB:  m.stats(w.memories),
+		}
+		if len(w.inits) > 0 {
+			s.InitDurationMs = m.stats(w.inits)
+		}
+		if len(w.restores) > 0 {
+			s.RestoreDurationMs = m.stats(w.restores)
+		}
+		return s
+	}
+	values := []emfValue{
+		{"Invocations", "Count", w.invocations},
+		{"ColdStarts", "Count", w.coldStarts},
+		{"Errors", "Count", w.errors},
+		{"BilledDuration", "Milliseconds", w.billedDurationMs},
+	}
+	values = append(values, m.statValues("Duration", "Milliseconds", w.durations)...)
+	values = append(values, m.statValues("MaxMemoryUsed", "Megabytes", w.memories)...)
+	values = append(values, m.statValues("InitDuration", "Milliseconds", w.inits)...)
+	values = append(values, m.statValues("RestoreDuration", "Milliseconds", w.restores)...)
+	doc := m.document(w.start, values)
+	doc["periodSeconds"] = m.aggregate.Seconds()
+	return doc
+}
+
+// stats returns the percentiles, the max and the average of the values.
+func (m *InvocationMetrics) stats(values []float64) map[string]float64 {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	st := make(map[string]float64, len(m.percentiles)+2)
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	for _, p := range m.percentiles {
+		st[percentileName(p)] = percentile(sorted, p)
+	}
+	st["max"] = sorted[len(sorted)-1]
+	st["avg"] = sum / float64(len(sorted))
+	return st
+}
+
+// statValues returns the EMF values of the percentiles and the max like "DurationP99" and "DurationMax".
+func (m *InvocationMetrics) statValues(name, unit string, values []float64) []emfValue {
+	if len(values) == 0 {
+		return nil
+	}
+	st := m.stats(values)
+	vs := make([]emfValue, 0, len(m.percentiles)+1)
+	for _, p := range m.percentiles {
+		pn := percentileName(p)
+		vs = append(vs, emfValue{name + "P" + pn[1:], unit, st[pn]})
+	}
+	return append(vs, emfValue{name + "Max", unit, st["max"]})
+}
+
+// document builds an EMF document of the values.
+func (m *InvocationMetrics) document(ts time.Time, values []emfValue) map[string]any {
+	defs := make([]emfMetric, 0, len(values))
+	doc := map[string]any{
+		"FunctionName": m.functionName,
+	}
+	if m.functionVersion != "" {
+		doc["functionVersion"] = m.functionVersion
+	}
+	for _, v := range values {
+		defs = append(defs, emfMetric{Name: v.name, Unit: v.unit})
+		doc[v.name] = v.value
+	}
+	doc["_aws"] = map[string]any{
+		"Timestamp": ts.UnixMilli(),
+		"CloudWatchMetrics": []map[string]any{
+			{
+				"Namespace":  m.namespace,
+				"Dimensions": [][]string{{"FunctionName"}},
+				"Metrics":    defs,
+			},
+		},
+	}
+	return doc
+}
+
+// percentile returns the p-th percentile (0-100) of the sorted values without interpolation.
+func percentile(sorted []float64, p float64) float64 {
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+// percentileName returns the name of the percentile like "p99" and "p99.9".
+func percentileName(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+func boolCount(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,211 @@
+package firetap_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/firetap"
+)
+
+func platformReport(ts time.Time, requestID, status string, duration float64, initDuration float64) string {
+	metrics := fmt.Sprintf(`"durationMs":%g,"billedDurationMs":%g,"memorySizeMB":128,"maxMemoryUsedMB":%g`, duration, duration+1, 50+duration/10)
+	if initDuration > 0 {
+		metrics += fmt.Sprintf(`,"initDurationMs":%g`, initDuration)
+	}
+	return fmt.Sprintf(`{"time":%q,"type":"platform.report","record":{"requestId":%q,"status":%q,"metrics":{%s}}}`,
+		ts.Format(time.RFC3339Nano), requestID, status, metrics)
+}
+
+func postTelemetry(t *testing.T, h http.Handler, events ...string) {
+	t.Helper()
+	body := "[" + strings.Join(events, ",") + "]"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+func decodeLines(t *testing.T, b []byte) []map[string]any {
+	t.Helper()
+	var docs []map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var doc map[string]any
+		if err := dec.Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func TestInvocationMetricsEMF(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-func")
+	ctx := context.Background()
+	m, err := firetap.NewInvocationMetrics(ctx, &firetap.InvocationMetricsConfig{Format: "emf", Namespace: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	m.SetWriter(&out)
+	sender := &testLogSender{}
+	h := (&firetap.Receiver{InvocationMetrics: m}).Handler(sender)
+
+	ts := time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC)
+	postTelemetry(t, h,
+		`{"time":"2024-06-15T00:00:00.000Z","type":"function","record":"hello"}`,
+		platformReport(ts, "r1", "success", 100, 250),
+		platformReport(ts.Add(time.Second), "r2", "timeout", 3000, 0),
+	)
+	if got := sender.String(); got != "hello\n" {
+		t.Errorf("platform.report must not be passed to the sender: %q", got)
+	}
+	docs := decodeLines(t, out.Bytes())
+	if len(docs) != 2 {
+		t.Fatalf("unexpected documents: %s", out.String())
+	}
+	cold, warm := docs[0], docs[1]
+	if cold["FunctionName"] != "my-func" || cold["requestId"] != "r1" || cold["Duration"] != 100.0 || cold["ColdStart"] != 1.0 || cold["InitDuration"] != 250.0 || cold["Errors"] != 0.0 {
+		t.Errorf("unexpected document of the cold start: %v", cold)
+	}
+	if warm["ColdStart"] != 0.0 || warm["Errors"] != 1.0 || warm["status"] != "timeout" || warm["InitDuration"] != nil {
+		t.Errorf("unexpected document: %v", warm)
+	}
+	aws := cold["_aws"].(map[string]any)
+	if aws["Timestamp"] != float64(ts.UnixMilli()) {
+		t.Errorf("unexpected timestamp: %v", aws["Timestamp"])
+	}
+	cwm := aws["CloudWatchMetrics"].([]any)[0].(map[string]any)
+	if cwm["Namespace"] != "test" || len(cwm["Metrics"].([]any)) != 6 {
+		t.Errorf("unexpected metrics: %v", cwm)
+	}
+}
+
+func TestInvocationMetricsAggregate(t *testing.T) {
+	ctx := context.Background()
+	m, err := firetap.NewInvocationMetrics(ctx, &firetap.InvocationMetricsConfig{
+		Format:      "record",
+		Aggregate:   firetap.Duration(time.Minute),
+		Percentiles: []float64{50, 99.9},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	m.SetWriter(&out)
+	h := (&firetap.Receiver{InvocationMetrics: m}).Handler(&testLogSender{})
+
+	ts := time.Date(2024, 6, 15, 0, 0, 10, 0, time.UTC)
+	postTelemetry(t, h, platformReport(ts, "r1", "success", 300, 250))
+	for i := 1; i <= 99; i++ {
+		postTelemetry(t, h, platformReport(ts.Add(time.Duration(i)*100*time.Millisecond), fmt.Sprint(i), "success", float64(i), 0))
+	}
+	if out.Len() != 0 {
+		t.Fatalf("the window must not be emitted until the period ends: %s", out.String())
+	}
+	// the first invocation in the next minute emits the window
+	postTelemetry(t, h, platformReport(ts.Add(time.Minute), "next", "error", 10, 0))
+	docs := decodeLines(t, out.Bytes())
+	if len(docs) != 1 {
+		t.Fatalf("unexpected records: %s", out.String())
+	}
+	var s firetap.InvocationSummary
+	b, _ := json.Marshal(docs[0])
+	json.Unmarshal(b, &s)
+	if s.Type != "invocation_summary" || s.Time != "2024-06-15T00:00:00Z" || s.PeriodSeconds != 60 {
+		t.Errorf("unexpected summary: %s", b)
+	}
+	if s.Invocations != 100 || s.ColdStarts != 1 || s.Errors != 0 || s.BilledDurationMs != 301+99*50+99 {
+		t.Errorf("unexpected counts: %s", b)
+	}
+	if s.DurationMs["p50"] != 50 || s.DurationMs["p99.9"] != 99 || s.DurationMs["max"] != 300 {
+		t.Errorf("unexpected durations: %v", s.DurationMs)
+	}
+	if s.InitDurationMs["max"] != 250 || s.RestoreDurationMs != nil {
+		t.Errorf("unexpected init durations: %v", s.InitDurationMs)
+	}
+
+	out.Reset()
+	if err := m.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	docs = decodeLines(t, out.Bytes())
+	if len(docs) != 1 || docs[0]["invocations"] != 1.0 || docs[0]["errors"] != 1.0 || docs[0]["time"] != "2024-06-15T00:01:00Z" {
+		t.Errorf("Close must emit the current window: %s", out.String())
+	}
+}
+
+func TestInvocationMetricsEmitClosed(t *testing.T) {
+	ctx := context.Background()
+	m, err := firetap.NewInvocationMetrics(ctx, &firetap.InvocationMetricsConfig{
+		Format:    "record",
+		Aggregate: firetap.Duration(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	m.SetWriter(&out)
+	h := (&firetap.Receiver{InvocationMetrics: m}).Handler(&testLogSender{})
+
+	ts := time.Date(2024, 6, 15, 0, 0, 10, 0, time.UTC)
+	postTelemetry(t, h, platformReport(ts, "r1", "success", 100, 0))
+	m.EmitClosed(ctx, ts.Add(49*time.Second))
+	if out.Len() != 0 {
+		t.Fatalf("the window must not be emitted until the period ends: %s", out.String())
+	}
+	// no invocation after the period
+	m.EmitClosed(ctx, ts.Add(50*time.Second))
+	docs := decodeLines(t, out.Bytes())
+	if len(docs) != 1 || docs[0]["invocations"] != 1.0 || docs[0]["time"] != "2024-06-15T00:00:00Z" {
+		t.Fatalf("the closed window must be emitted: %s", out.String())
+	}
+	out.Reset()
+	if err := m.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("the window must be emitted once: %s", out.String())
+	}
+}
+
+type chanWriter chan []byte
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- bytes.Clone(b)
+	return len(b), nil
+}
+
+func TestInvocationMetricsRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m, err := firetap.NewInvocationMetrics(ctx, &firetap.InvocationMetricsConfig{
+		Format:    "record",
+		Aggregate: firetap.Duration(200 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chanWriter, 1)
+	m.SetWriter(out)
+	h := (&firetap.Receiver{InvocationMetrics: m}).Handler(&testLogSender{})
+	go m.Run(ctx)
+
+	postTelemetry(t, h, platformReport(time.Now(), "r1", "success", 100, 0))
+	select {
+	case b := <-out:
+		if docs := decodeLines(t, b); len(docs) != 1 || docs[0]["invocations"] != 1.0 {
+			t.Errorf("unexpected summary: %s", b)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the window must be emitted when the period ends")
+	}
+}
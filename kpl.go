@@ -0,0 +1,89 @@
+package firetap
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// kplMagic is the prefix of the records aggregated by Kinesis Producer Library.
+// https://github.com/awslabs/amazon-kinesis-producer/blob/master/aggregation-format.md
+var kplMagic = []byte{0xf3, 0x89, 0x9a, 0xc2}
+
+// deaggregate returns the user records in the KPL aggregated record.
+// A record that is not aggregated is returned as is.
+func deaggregate(data []byte) ([][]byte, error) {
+	if len(data) < len(kplMagic)+md5.Size || !bytes.HasPrefix(data, kplMagic) {
+		return [][]byte{data}, nil
+	}
+	body := data[len(kplMagic) : len(data)-md5.Size]
+	sum := md5.Sum(body)
+	if !bytes.Equal(sum[:], data[len(data)-md5.Size:]) {
+		// not an aggregated record by chance
+		return [][]byte{data}, nil
+	}
+	var records [][]byte
+	// AggregatedRecord: field 3 is repeated Record
+	err := walkProtobuf(body, func(field int, value []byte) error {
+		if field != 3 {
+			return nil
+		}
+		// Record: field 3 is data
+		return walkProtobuf(value, func(field int, value []byte) error {
+			if field == 3 {
+				records = append(records, value)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid KPL aggregated record: %w", err)
+	}
+	return records, nil
+}
+
+var errInvalidProtobuf = errors.New("invalid protobuf")
+
+// walkProtobuf calls fn for the length-delimited fields of the protobuf message.
+// The varint and fixed fields are skipped.
+func walkProtobuf(b []byte, fn func(field int, value []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errInvalidProtobuf
+		}
+		b = b[n:]
+		field, wireType := int(key>>3), key&7
+		switch wireType {
+		case 0: // varint
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return errInvalidProtobuf
+			}
+			b = b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return errInvalidProtobuf
+			}
+			b = b[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errInvalidProtobuf
+			}
+			if err := fn(field, b[n:n+int(l)]); err != nil {
+				return err
+			}
+			b = b[n+int(l):]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return errInvalidProtobuf
+			}
+			b = b[4:]
+		default:
+			return errInvalidProtobuf
+		}
+	}
+	return nil
+}
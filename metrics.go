@@ -0,0 +1,217 @@
+package firetap
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	slogcontext "github.com/PumpkinSeed/slog-context"
+)
+
+const (
+	metricsOutputNone   = "none"
+	metricsOutputStdout = "stdout"
+	metricsOutputSink   = "sink"
+)
+
+// Metrics holds the cumulative counters of firetap itself.
+type Metrics struct {
+	Received       atomic.Int64
+	Sent           atomic.Int64
+	Ignored        atomic.Int64
+	Filtered       atomic.Int64
+	Dropped        atomic.Int64
+	DeadLettered   atomic.Int64
+	Retries        atomic.Int64
+	Flushes        atomic.Int64
+	FlushedRecords atomic.Int64
+	FlushLatencyMs atomic.Int64
+	CircuitOpens   atomic.Int64
+}
+
+var metrics = &Metrics{}
+
+func (m *Metrics) observeFlush(records int, latency time.Duration) {
+	m.Flushes.Add(1)
+	m.FlushedRecords.Add(int64(records))
+	m.FlushLatencyMs.Add(latency.Milliseconds())
+}
+
+// MetricsSnapshot is a point-in-time copy of Metrics.
+type MetricsSnapshot struct {
+	Received       int64 `json:"received"`
+	Sent           int64 `json:"sent"`
+	Ignored        int64 `json:"ignored"`
+	Filtered       int64 `json:"filtered"`
+	Dropped        int64 `json:"dropped"`
+	DeadLettered   int64 `json:"dead_lettered"`
+	Retries        int64 `json:"retries"`
+	Flushes        int64 `json:"flushes"`
+	FlushedRecords int64 `json:"flushed_records"`
+	FlushLatencyMs int64 `json:"flush_latency_ms"`
+	CircuitOpens   int64 `json:"circuit_opens"`
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		Received:       m.Received.Load(),
+		Sent:           m.Sent.Load(),
+		Ignored:        m.Ignored.Load(),
+		Filtered:       m.Filtered.Load(),
+		Dropped:        m.Dropped.Load(),
+		DeadLettered:   m.DeadLettered.Load(),
+		Retries:        m.Retries.Load(),
+		Flushes:        m.Flushes.Load(),
+		FlushedRecords: m.FlushedRecords.Load(),
+		FlushLatencyMs: m.FlushLatencyMs.Load(),
+		CircuitOpens:   m.CircuitOpens.Load(),
+	}
+}
+
+// MetricsEmitter emits the metrics periodically as CloudWatch Embedded Metric Format documents.
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+type MetricsEmitter struct {
+	output      string
+	interval    time.Duration
+	namespace   string
+	destination string
+	w           io.Writer
+	sender      *Pipeline
+	last        MetricsSnapshot
+}
+
+func NewMetricsEmitter(opt *Option, sender *Pipeline) *MetricsEmitter {
+	return &MetricsEmitter{
+		output:      opt.Metrics,
+		interval:    opt.MetricsInterval,
+		namespace:   opt.MetricsNamespace,
+		destination: sender.Destination(),
+		w:           os.Stdout,
+		sender:      sender,
+	}
+}
+
+func (e *MetricsEmitter) enabled() bool {
+	return e.output != metricsOutputNone && e.output != ""
+}
+
+// Run emits the metrics at the interval until ctx is done.
+// The final metrics are emitted by Close in the shutdown sequence.
+func (e *MetricsEmitter) Run(ctx context.Context) {
+	ctx = slogcontext.WithValue(ctx, "component", "metrics")
+	if !e.enabled() {
+		return
+	}
+	slog.InfoContext(ctx, "emitting metrics", "output", e.output, "interval", e.interval)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.emit(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close emits the final metrics. The sink is not flushed, so the caller must flush the sender after Close.
+func (e *MetricsEmitter) Close(ctx context.Context) {
+	ctx = slogcontext.WithValue(ctx, "component", "metrics")
+	if !e.enabled() {
+		return
+	}
+	e.write(ctx)
+}
+
+func (e *MetricsEmitter) emit(ctx context.Context) {
+	if e.write(ctx) && e.output == metricsOutputSink {
+		if err := e.sender.Flush(ctx); err != nil {
+			slog.WarnContext(ctx, "failed to flush metrics", "error", err)
+		}
+	}
+}
+
+// write writes the metrics document to the output and reports whether it is written.
+func (e *MetricsEmitter) write(ctx context.Context) bool {
+	doc := e.document(time.Now(), metrics.Snapshot())
+	b, err := json.Marshal(doc)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to marshal metrics", "error", err)
+		return false
+	}
+	b = append(b, '\n')
+	switch e.output {
+	case metricsOutputSink:
+		if err := e.sender.Send(ctx, Record{Time: time.Now(), Data: b}); err != nil {
+			slog.WarnContext(ctx, "failed to send metrics", "error", err)
+			return false
+		}
+	default:
+		if _, err := e.w.Write(b); err != nil {
+			slog.WarnContext(ctx, "failed to write metrics", "error", err)
+			return false
+		}
+	}
+	return true
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfValue struct {
+	name  string
+	unit  string
+	value any
+}
+
+// document builds an EMF document from the difference between the last snapshot.
+func (e *MetricsEmitter) document(now time.Time, cur MetricsSnapshot) map[string]any {
+	prev := e.last
+	e.last = cur
+	values := []emfValue{
+		{"RecordsReceived", "Count", cur.Received - prev.Received},
+		{"RecordsSent", "Count", cur.Sent - prev.Sent},
+		{"RecordsIgnored", "Count", cur.Ignored - prev.Ignored},
+		{"RecordsFiltered", "Count", cur.Filtered - prev.Filtered},
+		{"RecordsDropped", "Count", cur.Dropped - prev.Dropped},
+		{"RecordsDeadLettered", "Count", cur.DeadLettered - prev.DeadLettered},
+		{"Retries", "Count", cur.Retries - prev.Retries},
+		{"Flushes", "Count", cur.Flushes - prev.Flushes},
+		{"CircuitOpens", "Count", cur.CircuitOpens - prev.CircuitOpens},
+		{"QueueDepth", "Count", e.sender.Len()},
+	}
+	if flushes := cur.Flushes - prev.Flushes; flushes > 0 {
+		values = append(values,
+			emfValue{"FlushLatency", "Milliseconds", float64(cur.FlushLatencyMs-prev.FlushLatencyMs) / float64(flushes)},
+			emfValue{"BatchSize", "Count", float64(cur.FlushedRecords-prev.FlushedRecords) / float64(flushes)},
+		)
+	}
+
+	defs := make([]emfMetric, 0, len(values))
+	doc := map[string]any{
+		"FunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+		"Destination":  e.destination,
+	}
+	for _, v := range values {
+		defs = append(defs, emfMetric{Name: v.name, Unit: v.unit})
+		doc[v.name] = v.value
+	}
+	doc["_aws"] = map[string]any{
+		"Timestamp": now.UnixMilli(),
+		"CloudWatchMetrics": []map[string]any{
+			{
+				"Namespace":  e.namespace,
+				"Dimensions": [][]string{{"FunctionName", "Destination"}},
+				"Metrics":    defs,
+			},
+		},
+	}
+	return doc
+}
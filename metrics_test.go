@@ -0,0 +1,139 @@
+package firetap_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/firetap"
+)
+
+func postEvents(t *testing.T, h http.HandlerFunc, events ...string) {
+	t.Helper()
+	body := "[" + strings.Join(events, ",") + "]"
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMetricsEmitter(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-func")
+	t.Setenv("AWS_ACCESS_KEY_ID", "dummy")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "dummy")
+	t.Setenv("AWS_REGION", "us-east-1")
+	ctx := context.Background()
+	cfg, err := firetap.LoadConfig(&firetap.Option{StreamName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := firetap.NewPipeline(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := firetap.NewMetricsEmitter(&firetap.Option{Metrics: "stdout", MetricsNamespace: "test"}, s)
+	var out bytes.Buffer
+	e.SetWriter(&out)
+	h := firetap.HandleTelemetry(&testLogSender{}, false)
+
+	e.Emit(ctx) // the counters so far
+	postEvents(t, h,
+		`{"time":"2024-06-15T00:00:00.000Z","type":"function","record":"foo"}`,
+		`{"time":"2024-06-15T00:00:00.001Z","type":"function","record":"bar"}`,
+		`{"time":"2024-06-15T00:00:00.002Z","type":"platform.start","record":{"requestId":"r1"}}`,
+	)
+	e.Emit(ctx)
+	e.Emit(ctx)
+
+	var docs []map[string]any
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var doc map[string]any
+		if err := dec.Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) != 3 {
+		t.Fatalf("unexpected documents: %v", docs)
+	}
+	doc := docs[1]
+	if doc["FunctionName"] != "my-func" || doc["Destination"] != "test" {
+		t.Errorf("unexpected dimensions: %v", doc)
+	}
+	if doc["RecordsReceived"] != 3.0 || doc["RecordsSent"] != 2.0 || doc["RecordsIgnored"] != 1.0 || doc["QueueDepth"] != 0.0 {
+		t.Errorf("counters must be the deltas since the last emission: %v", doc)
+	}
+	aws := doc["_aws"].(map[string]any)
+	if _, ok := aws["Timestamp"].(float64); !ok {
+		t.Errorf("unexpected timestamp: %v", aws["Timestamp"])
+	}
+	cwm := aws["CloudWatchMetrics"].([]any)
+	if len(cwm) != 1 {
+		t.Fatalf("unexpected CloudWatchMetrics: %v", cwm)
+	}
+	def := cwm[0].(map[string]any)
+	if def["Namespace"] != "test" {
+		t.Errorf("unexpected namespace: %v", def["Namespace"])
+	}
+	if dims := def["Dimensions"].([]any); len(dims) != 1 || len(dims[0].([]any)) != 2 || dims[0].([]any)[0] != "FunctionName" || dims[0].([]any)[1] != "Destination" {
+		t.Errorf("unexpected dimensions: %v", dims)
+	}
+	units := map[string]string{}
+	for _, m := range def["Metrics"].([]any) {
+		m := m.(map[string]any)
+		name := m["Name"].(string)
+		units[name] = m["Unit"].(string)
+		if _, ok := doc[name]; !ok {
+			t.Errorf("metric %s has no value", name)
+		}
+	}
+	for name, unit := range map[string]string{"RecordsReceived": "Count", "RecordsSent": "Count", "QueueDepth": "Count"} {
+		if units[name] != unit {
+			t.Errorf("unit of %s = %q, want %q", name, units[name], unit)
+		}
+	}
+
+	next := docs[2]
+	if next["RecordsReceived"] != 0.0 || next["RecordsSent"] != 0.0 || next["Flushes"] != 0.0 {
+		t.Errorf("counters must be the deltas since the last emission: %v", next)
+	}
+	if _, ok := next["FlushLatency"]; ok {
+		t.Errorf("FlushLatency must be omitted without flushes: %v", next)
+	}
+}
+
+func TestMetricsEmitterClose(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-func")
+	t.Setenv("AWS_ACCESS_KEY_ID", "dummy")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "dummy")
+	t.Setenv("AWS_REGION", "us-east-1")
+	ctx := context.Background()
+	cfg, err := firetap.LoadConfig(&firetap.Option{StreamName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := firetap.NewPipeline(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := firetap.NewMetricsEmitter(&firetap.Option{Metrics: "sink", MetricsInterval: time.Hour, MetricsNamespace: "test"}, s)
+
+	// Run doesn't emit after ctx is done, Close does
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	e.Run(cctx)
+	if n := s.Len(); n != 0 {
+		t.Fatalf("Run must not emit after ctx is done: %d", n)
+	}
+	e.Close(ctx)
+	if n := s.Len(); n != 1 {
+		t.Fatalf("Close must send the final metrics without flush: %d", n)
+	}
+}
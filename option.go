@@ -2,22 +2,89 @@ package firetap
 
 import (
 	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/alecthomas/kong"
 )
 
 type Option struct {
-	StreamName string `help:"Firehose or DataStream name" env:"FIRETAP_STREAM_NAME" required:""`
+	Config     string `help:"Path of the pipeline configuration file (.json, .yaml or .jsonnet)" env:"FIRETAP_CONFIG"`
+	StreamName string `help:"Firehose or DataStream name" env:"FIRETAP_STREAM_NAME"`
 	DataStream bool   `help:"The flag to use DataStream instead of Firehose" env:"FIRETAP_DATA_STREAM" default:"false"`
+	DeadLetter string `help:"Dead letter destination for the records failed to send (file:///path, s3://bucket/prefix, sqs://queue-name)" env:"FIRETAP_DEAD_LETTER"`
 	Port       int    `help:"The port to listen on" default:"8080" env:"FIRETAP_PORT"`
 	Debug      bool   `help:"Enable debug mode" env:"FIRETAP_DEBUG" default:"false"`
+	TagRecords bool   `help:"Add the request ID passed by the wrapper to each record (the stream is always added)" env:"FIRETAP_TAG_RECORDS" default:"false"`
+	Pprof      bool   `help:"Enable /debug/pprof on the receiver" env:"FIRETAP_PPROF" default:"false"`
+
+	ReloadSource   string        `help:"Source of the reloadable configuration (ssm:///parameter-name, appconfig://application/environment/profile)" env:"FIRETAP_RELOAD_SOURCE"`
+	ReloadInterval time.Duration `help:"Minimum interval to poll the reloadable configuration on INVOKE events" default:"60s" env:"FIRETAP_RELOAD_INTERVAL"`
+
+	Metrics          string        `help:"Output of the metrics of firetap itself in EMF (none, stdout, sink)" enum:"none,stdout,sink" default:"none" env:"FIRETAP_METRICS"`
+	MetricsInterval  time.Duration `help:"Interval to emit the metrics" default:"60s" env:"FIRETAP_METRICS_INTERVAL"`
+	MetricsNamespace string        `help:"CloudWatch namespace of the metrics" default:"firetap" env:"FIRETAP_METRICS_NAMESPACE"`
+
+	StderrPassthrough bool   `help:"Also write the stderr of the handler to the real stderr in the wrapper" env:"FIRETAP_STDERR_PASSTHROUGH" default:"false"`
+	RuntimeProxy      bool   `help:"Run a proxy of the Lambda Runtime API for the handler in the wrapper" env:"FIRETAP_RUNTIME_PROXY" default:"false"`
+	BufferMaxEvents   int    `help:"Maximum number of the lines buffered by the wrapper (default 10000)" env:"FIRETAP_BUFFER_MAX_EVENTS"`
+	BufferMaxBytes    int    `help:"Maximum bytes of the lines buffered by the wrapper (default 16MiB)" env:"FIRETAP_BUFFER_MAX_BYTES"`
+	DropPolicy        string `help:"Behavior on exceeding the buffer of the wrapper (block, drop_oldest, drop_newest)" env:"FIRETAP_DROP_POLICY"`
+
+	Extension struct{}       `cmd:"" default:"1" help:"Run as a Lambda extension (default)" json:"-"`
+	Send      SendOption     `cmd:"" help:"Send logs from files or stdin to the destination through the pipeline" json:"-"`
+	Tail      TailOption     `cmd:"" help:"Print the logs in the Kinesis Data Stream" json:"-"`
+	Validate  ValidateOption `cmd:"" help:"Validate the configuration and run sample lines through the pipeline" json:"-"`
+	Bench     BenchOption    `cmd:"" help:"Benchmark the receiver and the pipeline with synthetic telemetry" json:"-"`
+
+	command string
+}
+
+// SendOption represents the options of the send command.
+type SendOption struct {
+	Files  []string `arg:"" optional:"" help:"Files to read. Reads stdin when omitted or \"-\""`
+	Format string   `help:"Format of the input (auto, lines, telemetry, dead_letter)" enum:"auto,lines,telemetry,dead_letter" default:"auto"`
+	DryRun bool     `help:"Print the records with the output and stream names instead of sending them"`
+}
+
+// ValidateOption represents the options of the validate command.
+type ValidateOption struct {
+	Samples []string `arg:"" optional:"" help:"Files of the sample lines to run through the pipeline. \"-\" reads stdin"`
+	Format  string   `help:"Format of the samples (auto, lines, telemetry)" enum:"auto,lines,telemetry" default:"auto"`
+	Check   bool     `help:"Check the destinations exist and are active by DescribeDeliveryStream and DescribeStreamSummary"`
 }
 
 func NewOption() (*Option, error) {
 	opt := &Option{}
-	kong.Parse(opt)
+	kctx := kong.Parse(opt, kong.Name("firetap"))
+	opt.command = strings.Fields(kctx.Command())[0]
 	if opt.Debug {
 		LogLevel.Set(slog.LevelDebug)
 	}
 	return opt, nil
 }
+
+// NewWrapperOption returns the options from the environment variables.
+// The arguments are not parsed because they belong to the runtime of the handler.
+func NewWrapperOption() (*Option, error) {
+	opt := &Option{}
+	parser, err := kong.New(opt, kong.Name("firetap"))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parser.Parse(nil); err != nil {
+		return nil, err
+	}
+	if opt.Debug {
+		LogLevel.Set(slog.LevelDebug)
+	}
+	return opt, nil
+}
+
+// Command returns the subcommand name (extension, send, tail, validate, bench).
+func (opt *Option) Command() string {
+	if opt.command == "" {
+		return "extension"
+	}
+	return opt.command
+}
@@ -0,0 +1,344 @@
+package firetap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	slogcontext "github.com/PumpkinSeed/slog-context"
+)
+
+const (
+	defaultTracesTimeout = 5 * time.Second
+
+	// spanExportInterval is the interval of the export in the background,
+	// in addition to the export after each request of the Telemetry API.
+	spanExportInterval = 10 * time.Second
+
+	// maxBufferedSpans is the max number of the spans waiting for the export.
+	maxBufferedSpans = 10000
+
+	otlpSpanKindInternal = 1
+	otlpStatusCodeError  = 2
+)
+
+// platformSpan is a span in the platform events.
+// https://docs.aws.amazon.com/lambda/latest/dg/telemetry-schema-reference.html#Span
+type platformSpan struct {
+	Name       string  `json:"name"`
+	Start      string  `json:"start"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+// OTLP/HTTP JSON encoding of the traces.
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+// SpanExporter exports the spans in the platform events as OTLP traces.
+// The spans of an invocation are parented to the trace context of the invocation,
+// and the spans of the initialization are put into the trace of the first invocation.
+//
+// The spans are exported by Run in the background, so a slow collector does not block
+// the delivery of the logs.
+type SpanExporter struct {
+	endpoint    string
+	headers     map[string]string
+	sampledOnly bool
+	client      *http.Client
+	resource    otlpResource
+	notify      chan struct{}
+
+	mu        sync.Mutex
+	spans     []otlpSpan
+	initSpans []otlpSpan // waiting for the first invocation
+}
+
+// NewSpanExporter creates a SpanExporter.
+func NewSpanExporter(cfg *TracesConfig) (*SpanExporter, error) {
+	endpoint, err := otlpTracesEndpoint(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout == 0 {
+		timeout = defaultTracesTimeout
+	}
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	}
+	return &SpanExporter{
+		endpoint:    endpoint,
+		headers:     cfg.Headers,
+		sampledOnly: cfg.SampledOnly,
+		client:      &http.Client{Timeout: timeout},
+		notify:      make(chan struct{}, 1),
+		resource: otlpResource{Attributes: []otlpKeyValue{
+			otlpString("service.name", serviceName),
+			otlpString("cloud.provider", "aws"),
+			otlpString("cloud.platform", "aws_lambda"),
+			otlpString("cloud.region", os.Getenv("AWS_REGION")),
+			otlpString("faas.name", os.Getenv("AWS_LAMBDA_FUNCTION_NAME")),
+			otlpString("faas.version", os.Getenv("AWS_LAMBDA_FUNCTION_VERSION")),
+			otlpString("faas.instance", os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME")),
+		}},
+	}, nil
+}
+
+// otlpTracesEndpoint appends the path of the traces (/v1/traces) to the endpoint without a path.
+func otlpTracesEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid OTLP endpoint %q", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// Run exports the buffered spans when notified or periodically until ctx is done.
+// The spans left are exported by Close.
+func (e *SpanExporter) Run(ctx context.Context) {
+	ctx = slogcontext.WithValue(ctx, "component", "span-exporter")
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.notify:
+		case <-ticker.C:
+		}
+		if err := e.flush(ctx); err != nil {
+			slog.WarnContext(ctx, "failed to export spans", "error", err)
+		}
+	}
+}
+
+// kick notifies Run of the spans to export without blocking.
+func (e *SpanExporter) kick() {
+	select {
+	case e.notify <- struct{}{}:
+	default:
+	}
+}
+
+// observe converts the spans of the platform event into the OTLP spans,
+// parented to the trace context of the invocation in traces.
+//
+// A new trace is started in traces for an invocation without the trace context
+// (unless sampledOnly), so the logs of the invocation are linked to the spans.
+func (e *SpanExporter) observe(ctx context.Context, typ string, record []byte, traces *traceContexts) {
+	var r struct {
+		RequestID string         `json:"requestId"`
+		Status    string         `json:"status"`
+		Spans     []platformSpan `json:"spans"`
+	}
+	if err := json.Unmarshal(record, &r); err != nil {
+		slog.WarnContext(ctx, "failed to decode platform event", "type", typ, "error", err)
+		return
+	}
+	isInit := r.RequestID == "" || strings.HasPrefix(typ, "platform.init") || strings.HasPrefix(typ, "platform.restore")
+	var tc traceContext
+	var traced bool
+	if !isInit {
+		if tc, traced = traces.get(r.RequestID); !traced && !e.sampledOnly {
+			tc, traced = traceContext{TraceID: newTraceID(), Sampled: true}, true
+			traces.set(r.RequestID, tc, false)
+		}
+	}
+	if len(r.Spans) == 0 {
+		return
+	}
+	var attrs []otlpKeyValue
+	if r.RequestID != "" {
+		attrs = append(attrs, otlpString("faas.invocation_id", r.RequestID))
+	}
+	var status *otlpStatus
+	if r.Status != "" && r.Status != "success" {
+		status = &otlpStatus{Code: otlpStatusCodeError, Message: r.Status}
+	}
+	spans := make([]otlpSpan, 0, len(r.Spans))
+	for _, s := range r.Spans {
+		start, err := time.Parse(time.RFC3339Nano, s.Start)
+		if err != nil {
+			slog.WarnContext(ctx, "invalid start of span", "span", s.Name, "error", err)
+			continue
+		}
+		end := start.Add(time.Duration(s.DurationMs * float64(time.Millisecond)))
+		spans = append(spans, otlpSpan{
+			SpanID:            newSpanID(),
+			Name:              s.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+			Attributes:        attrs,
+			Status:            status,
+		})
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if isInit {
+		e.initSpans = append(e.initSpans, spans...)
+		return
+	}
+	if !traced || (e.sampledOnly && !tc.Sampled) {
+		return
+	}
+	for i := range spans {
+		spans[i].TraceID = tc.TraceID
+		spans[i].ParentSpanID = tc.SpanID
+	}
+	e.buffer(ctx, spans...)
+	if len(e.initSpans) > 0 {
+		for i := range e.initSpans {
+			e.initSpans[i].TraceID = tc.TraceID
+			e.initSpans[i].ParentSpanID = tc.SpanID
+		}
+		e.buffer(ctx, e.initSpans...)
+		e.initSpans = nil
+	}
+}
+
+func (e *SpanExporter) buffer(ctx context.Context, spans ...otlpSpan) {
+	if n := len(e.spans) + len(spans) - maxBufferedSpans; n > 0 {
+		slog.WarnContext(ctx, "too many spans are buffered, dropping the oldest", "dropped", n)
+		e.spans = e.spans[min(n, len(e.spans)):]
+	}
+	e.spans = append(e.spans, spans...)
+}
+
+// flush exports the buffered spans. The spans failed to export are dropped.
+func (e *SpanExporter) flush(ctx context.Context) error {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	ctx = slogcontext.WithValue(ctx, "component", "span-exporter")
+	body, err := json.Marshal(otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: e.resource,
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "firetap"},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal spans: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export %d spans: %w", len(spans), err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to export %d spans: %d %s", len(spans), resp.StatusCode, string(b))
+	}
+	slog.DebugContext(ctx, "spans exported", "spans", len(spans))
+	return nil
+}
+
+// Close exports the buffered spans including the spans of the initialization
+// not put into any invocation (in a new trace).
+func (e *SpanExporter) Close(ctx context.Context) error {
+	e.mu.Lock()
+	if len(e.initSpans) > 0 && !e.sampledOnly {
+		traceID := newTraceID()
+		for i := range e.initSpans {
+			e.initSpans[i].TraceID = traceID
+		}
+		e.buffer(ctx, e.initSpans...)
+	}
+	e.initSpans = nil
+	e.mu.Unlock()
+	return e.flush(ctx)
+}
+
+func newTraceID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newSpanID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,283 @@
+package firetap_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/firetap"
+)
+
+type collectedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Start        string `json:"startTimeUnixNano"`
+	End          string `json:"endTimeUnixNano"`
+	Status       *struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+// otlpCollector is a stand-in of the OTLP/HTTP collector.
+type otlpCollector struct {
+	mu       sync.Mutex
+	spans    []collectedSpan
+	resource map[string]string
+	header   http.Header
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/v1/traces" {
+		http.NotFound(w, req)
+		return
+	}
+	var body struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string `json:"key"`
+					Value struct {
+						StringValue string `json:"stringValue"`
+					} `json:"value"`
+				} `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []collectedSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header = req.Header
+	for _, rs := range body.ResourceSpans {
+		c.resource = map[string]string{}
+		for _, a := range rs.Resource.Attributes {
+			c.resource[a.Key] = a.Value.StringValue
+		}
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func (c *otlpCollector) byName() map[string]collectedSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[string]collectedSpan, len(c.spans))
+	for _, s := range c.spans {
+		m[s.Name] = s
+	}
+	return m
+}
+
+// waitSpans waits for n spans to be collected.
+func (c *otlpCollector) waitSpans(t *testing.T, n int) map[string]collectedSpan {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		spans := c.byName()
+		if len(spans) >= n || time.Now().After(deadline) {
+			return spans
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestSpanExporter(t *testing.T, cfg firetap.TracesConfig) (*firetap.SpanExporter, *otlpCollector) {
+	t.Helper()
+	c := &otlpCollector{}
+	ts := httptest.NewServer(c)
+	t.Cleanup(ts.Close)
+	cfg.Endpoint = ts.URL
+	e, err := firetap.NewSpanExporter(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, c
+}
+
+func TestSpanExporter(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-func")
+	e, c := newTestSpanExporter(t, firetap.TracesConfig{Headers: map[string]string{"X-Api-Key": "secret"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Run(ctx)
+	sender := &testLogSender{}
+	h := (&firetap.Receiver{Spans: e}).Handler(sender)
+
+	postTelemetry(t, h,
+		`{"time":"2024-06-15T00:00:00.000Z","type":"platform.initRuntimeDone","record":{"initializationType":"on-demand","phase":"init","status":"success","spans":[{"name":"initRuntime","start":"2024-06-15T00:00:00.000Z","durationMs":120.5}]}}`,
+		`{"time":"2024-06-15T00:00:01.000Z","type":"platform.start","record":{"requestId":"r1","version":"$LATEST","tracing":{"spanId":"24cd7d670fa455f0","type":"X-Amzn-Trace-Id","value":"Root=1-5e1b4151-5ac6c58f2a0c3d4d4c7e1b2f;Parent=53995c3f42cd8ad8;Sampled=1"}}}`,
+		`{"time":"2024-06-15T00:00:01.100Z","type":"function","record":"hello"}`,
+		`{"time":"2024-06-15T00:00:01.200Z","type":"platform.runtimeDone","record":{"requestId":"r1","status":"error","spans":[{"name":"responseLatency","start":"2024-06-15T00:00:01.000Z","durationMs":150},{"name":"responseDuration","start":"2024-06-15T00:00:01.150Z","durationMs":0.5}]}}`,
+	)
+	if got := sender.String(); got != "hello\n" {
+		t.Errorf("platform events must not be passed to the sender: %q", got)
+	}
+	// exported by Run in the background
+	spans := c.waitSpans(t, 3)
+	if len(spans) != 3 {
+		t.Fatalf("unexpected spans: %v", spans)
+	}
+	for name, s := range spans {
+		if s.TraceID != "5e1b41515ac6c58f2a0c3d4d4c7e1b2f" || s.ParentSpanID != "24cd7d670fa455f0" || len(s.SpanID) != 16 {
+			t.Errorf("%s: unexpected trace context: %+v", name, s)
+		}
+	}
+	if s := spans["responseLatency"]; s.Start != "1718409601000000000" || s.End != "1718409601150000000" || s.Status == nil || s.Status.Code != 2 {
+		t.Errorf("unexpected span: %+v", s)
+	}
+	if s := spans["initRuntime"]; s.Start != "1718409600000000000" || s.End != "1718409600120500000" || s.Status != nil {
+		t.Errorf("unexpected init span: %+v", s)
+	}
+	if c.resource["service.name"] != "my-func" || c.resource["cloud.platform"] != "aws_lambda" {
+		t.Errorf("unexpected resource: %v", c.resource)
+	}
+	if c.header.Get("X-Api-Key") != "secret" {
+		t.Errorf("headers must be sent: %v", c.header)
+	}
+}
+
+func TestSpanExporterUntraced(t *testing.T) {
+	e, c := newTestSpanExporter(t, firetap.TracesConfig{})
+	h := (&firetap.Receiver{Spans: e}).Handler(&testLogSender{})
+
+	postTelemetry(t, h,
+		`{"time":"2024-06-15T00:00:00.000Z","type":"platform.initRuntimeDone","record":{"status":"success","spans":[{"name":"initRuntime","start":"2024-06-15T00:00:00.000Z","durationMs":100}]}}`,
+	)
+	if err := e.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if spans := c.byName(); len(spans) != 0 {
+		t.Fatalf("init spans must wait for the first invocation: %v", spans)
+	}
+	postTelemetry(t, h,
+		`{"time":"2024-06-15T00:00:01.000Z","type":"platform.runtimeDone","record":{"requestId":"r1","status":"success","spans":[{"name":"responseLatency","start":"2024-06-15T00:00:01.000Z","durationMs":10}]}}`,
+		`{"time":"2024-06-15T00:00:01.100Z","type":"platform.report","record":{"requestId":"r1","status":"success","spans":[{"name":"extensionOverhead","start":"2024-06-15T00:00:01.010Z","durationMs":5}]}}`,
+	)
+	if err := e.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := c.byName()
+	if len(spans) != 3 {
+		t.Fatalf("unexpected spans: %v", spans)
+	}
+	traceID := spans["responseLatency"].TraceID
+	if len(traceID) != 32 || strings.Trim(traceID, "0") == "" {
+		t.Fatalf("invalid trace ID: %q", traceID)
+	}
+	for name, s := range spans {
+		if s.TraceID != traceID || s.ParentSpanID != "" {
+			t.Errorf("%s: the spans of an untraced invocation must share a new trace: %+v", name, s)
+		}
+	}
+
+	// init spans without any invocation are exported by Close
+	postTelemetry(t, h,
+		`{"time":"2024-06-15T00:01:00.000Z","type":"platform.restoreRuntimeDone","record":{"status":"success","spans":[{"name":"restoreRuntime","start":"2024-06-15T00:01:00.000Z","durationMs":10}]}}`,
+	)
+	if err := e.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := c.byName()["restoreRuntime"]; !ok || s.TraceID == traceID || len(s.TraceID) != 32 {
+		t.Errorf("unexpected span: %+v", s)
+	}
+}
+
+func TestSpanExporterSampledOnly(t *testing.T) {
+	e, c := newTestSpanExporter(t, firetap.TracesConfig{SampledOnly: true})
+	rcv := &firetap.Receiver{Spans: e}
+	h := rcv.Handler(&testLogSender{})
+
+	ev := &firetap.ExtensionEvent{EventType: "INVOKE", RequestID: "r2"}
+	ev.Tracing.Type = "traceparent"
+	ev.Tracing.Value = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	rcv.ObserveInvoke(ev)
+	postTelemetry(t, h,
+		// r1: not sampled
+		`{"time":"2024-06-15T00:00:00.000Z","type":"platform.start","record":{"requestId":"r1","tracing":{"type":"X-Amzn-Trace-Id","value":"Root=1-5e1b4151-5ac6c58f2a0c3d4d4c7e1b2f;Sampled=0"}}}`,
+		`{"time":"2024-06-15T00:00:00.100Z","type":"platform.runtimeDone","record":{"requestId":"r1","status":"success","spans":[{"name":"r1","start":"2024-06-15T00:00:00.000Z","durationMs":10}]}}`,
+		// r2: sampled by the INVOKE event
+		`{"time":"2024-06-15T00:00:01.000Z","type":"platform.start","record":{"requestId":"r2"}}`,
+		`{"time":"2024-06-15T00:00:01.100Z","type":"platform.runtimeDone","record":{"requestId":"r2","status":"success","spans":[{"name":"r2","start":"2024-06-15T00:00:01.000Z","durationMs":10}]}}`,
+		// r3: untraced
+		`{"time":"2024-06-15T00:00:02.100Z","type":"platform.runtimeDone","record":{"requestId":"r3","status":"success","spans":[{"name":"r3","start":"2024-06-15T00:00:02.000Z","durationMs":10}]}}`,
+	)
+	if err := e.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := c.byName()
+	if len(spans) != 1 {
+		t.Fatalf("only the sampled invocation must be exported: %v", spans)
+	}
+	if s := spans["r2"]; s.TraceID != "0af7651916cd43dd8448eb211c80319c" || s.ParentSpanID != "b7ad6b7169203331" {
+		t.Errorf("unexpected span: %+v", s)
+	}
+}
+
+func TestSpanExporterUntracedTraceContext(t *testing.T) {
+	e, c := newTestSpanExporter(t, firetap.TracesConfig{})
+	sender := &testLogSender{}
+	h := (&firetap.Receiver{TraceContext: true, TagRecords: true, Spans: e}).Handler(sender)
+
+	postTelemetry(t, h,
+		`{"time":"2024-06-15T00:00:01.000Z","type":"platform.start","record":{"requestId":"r1"}}`,
+		`{"time":"2024-06-15T00:00:01.100Z","type":"function","record":"{\"msg\":\"hello\"}"}`,
+		`{"time":"2024-06-15T00:00:01.200Z","type":"platform.runtimeDone","record":{"requestId":"r1","status":"success","spans":[{"name":"responseLatency","start":"2024-06-15T00:00:01.000Z","durationMs":150}]}}`,
+	)
+	if err := e.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s, ok := c.byName()["responseLatency"]
+	if !ok {
+		t.Fatal("span must be exported")
+	}
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(sender.String()), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["trace_id"] != s.TraceID {
+		t.Errorf("the logs must be linked to the new trace %s: %v", s.TraceID, doc)
+	}
+	if _, ok := doc["span_id"]; ok {
+		t.Errorf("span_id must not be tagged without the parent span: %v", doc)
+	}
+}
+
+func TestSpanExporterSlowCollector(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	t.Cleanup(ts.Close)
+	defer close(release)
+	e, err := firetap.NewSpanExporter(&firetap.TracesConfig{Endpoint: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Run(ctx)
+	h := (&firetap.Receiver{Spans: e}).Handler(&testLogSender{})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		postTelemetry(t, h,
+			`{"time":"2024-06-15T00:00:01.200Z","type":"platform.runtimeDone","record":{"requestId":"r1","status":"success","spans":[{"name":"responseLatency","start":"2024-06-15T00:00:01.000Z","durationMs":150}]}}`,
+		)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("a slow collector must not block the Telemetry API: %s", d)
+	}
+}
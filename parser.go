@@ -0,0 +1,217 @@
+package firetap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	parseFormatLogfmt = "logfmt"
+	parseFormatLambda = "lambda"
+	parseFormatPython = "python"
+	parseFormatNode   = "node"
+	parseFormatRegexp = "regexp"
+	parseFormatAuto   = "auto"
+)
+
+var errNotMatched = errors.New("not matched")
+
+// lineParser parses a text line into fields.
+type lineParser func(line string) (map[string]any, error)
+
+// parser is a Processor that converts text records into JSON objects.
+// JSON object records are passed as is.
+// When the parsed "timestamp" field is RFC3339, it is used as the time of the record.
+// When the line cannot be parsed, it is converted to {"message": line}.
+type parser struct {
+	parse lineParser
+}
+
+func newParser(cfg ProcessorConfig) (*parser, error) {
+	switch cfg.Format {
+	case parseFormatLogfmt:
+		return &parser{parse: parseLogfmt}, nil
+	case parseFormatLambda, parseFormatNode:
+		return &parser{parse: parseLambdaText}, nil
+	case parseFormatPython:
+		return &parser{parse: parsePythonText}, nil
+	case parseFormatAuto:
+		return &parser{parse: parseAuto}, nil
+	case parseFormatRegexp:
+		re, err := compileParsePattern(cfg.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return &parser{parse: regexpParser(re)}, nil
+	default:
+		return nil, fmt.Errorf("unknown parse format: %s", cfg.Format)
+	}
+}
+
+func compileParsePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			return re, nil
+		}
+	}
+	return nil, fmt.Errorf("pattern must have named groups like (?P<level>\\w+): %s", pattern)
+}
+
+func (p *parser) Process(_ context.Context, rec Record) (Record, bool) {
+	line := bytes.TrimRight(rec.Data, "\r\n")
+	if len(line) > 0 && line[0] == '{' && json.Valid(line) {
+		return rec, true
+	}
+	fields, err := p.parse(string(line))
+	if err != nil {
+		fields = map[string]any{"message": string(line)}
+	}
+	if v, ok := fields["timestamp"].(string); ok {
+		// the time written by the function is more accurate than the time of the event
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			rec.Time = t
+		}
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		b, _ = json.Marshal(map[string]any{"message": string(line)})
+	}
+	rec.Data = append(b, '\n')
+	return rec, true
+}
+
+// parseLambdaText parses the default text format of Lambda (and Node.js runtime).
+//
+//	2024-06-15T00:00:00.000Z\t8f507cfc-xmpl-4697-b07a-ac58fc914c95\tINFO\tmessage
+func parseLambdaText(line string) (map[string]any, error) {
+	parts := strings.SplitN(line, "\t", 4)
+	if len(parts) != 4 || !looksLikeTimestamp(parts[0]) {
+		return nil, errNotMatched
+	}
+	return map[string]any{
+		"timestamp": parts[0],
+		"requestId": parts[1],
+		"level":     parts[2],
+		"message":   parts[3],
+	}, nil
+}
+
+// parsePythonText parses the default format of the logging module in the Lambda Python runtime.
+//
+//	[INFO]\t2024-06-15T00:00:00.000Z\t8f507cfc-xmpl-4697-b07a-ac58fc914c95\tmessage
+func parsePythonText(line string) (map[string]any, error) {
+	parts := strings.SplitN(line, "\t", 4)
+	if len(parts) != 4 || !strings.HasPrefix(parts[0], "[") || !strings.HasSuffix(parts[0], "]") || !looksLikeTimestamp(parts[1]) {
+		return nil, errNotMatched
+	}
+	return map[string]any{
+		"level":     strings.Trim(parts[0], "[]"),
+		"timestamp": parts[1],
+		"requestId": parts[2],
+		"message":   parts[3],
+	}, nil
+}
+
+// parseAuto tries the Lambda formats.
+func parseAuto(line string) (map[string]any, error) {
+	for _, parse := range []lineParser{parseLambdaText, parsePythonText} {
+		if fields, err := parse(line); err == nil {
+			return fields, nil
+		}
+	}
+	return nil, errNotMatched
+}
+
+func looksLikeTimestamp(s string) bool {
+	return len(s) >= 20 && s[4] == '-' && s[7] == '-' && s[10] == 'T'
+}
+
+func regexpParser(re *regexp.Regexp) lineParser {
+	names := re.SubexpNames()
+	return func(line string) (map[string]any, error) {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			return nil, errNotMatched
+		}
+		fields := make(map[string]any, len(names))
+		for i, name := range names {
+			if name != "" {
+				fields[name] = m[i]
+			}
+		}
+		return fields, nil
+	}
+}
+
+// parseLogfmt parses a logfmt line like `level=info msg="hello world" ok`.
+// A key without a value is true.
+func parseLogfmt(line string) (map[string]any, error) {
+	fields := map[string]any{}
+	s := strings.TrimSpace(line)
+	var hasValue bool
+	for len(s) > 0 {
+		i := strings.IndexFunc(s, func(r rune) bool { return r == '=' || unicode.IsSpace(r) })
+		if i == 0 {
+			return nil, errNotMatched
+		}
+		if i < 0 {
+			fields[s] = true
+			break
+		}
+		key := s[:i]
+		if s[i] != '=' {
+			fields[key] = true
+			s = strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+			continue
+		}
+		hasValue = true
+		s = s[i+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := quotedEnd(s)
+			if end < 0 {
+				return nil, errNotMatched
+			}
+			v, err := strconv.Unquote(s[:end])
+			if err != nil {
+				return nil, errNotMatched
+			}
+			value, s = v, s[end:]
+		} else if j := strings.IndexFunc(s, unicode.IsSpace); j >= 0 {
+			value, s = s[:j], s[j:]
+		} else {
+			value, s = s, ""
+		}
+		fields[key] = value
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	}
+	if !hasValue {
+		return nil, errNotMatched
+	}
+	return fields, nil
+}
+
+// quotedEnd returns the index after the closing quote of the quoted string at the head of s.
+func quotedEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
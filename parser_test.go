@@ -0,0 +1,135 @@
+package firetap_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/firetap"
+)
+
+var parseTests = []struct {
+	name    string
+	format  string
+	pattern string
+	line    string
+	want    map[string]any
+}{
+	{
+		name:   "logfmt",
+		format: "logfmt",
+		line:   `level=info msg="hello \"world\"" ok duration=1.5s` + "\n",
+		want:   map[string]any{"level": "info", "msg": `hello "world"`, "ok": true, "duration": "1.5s"},
+	},
+	{
+		name:   "logfmt not matched",
+		format: "logfmt",
+		line:   "hello world\n",
+		want:   map[string]any{"message": "hello world"},
+	},
+	{
+		name:   "lambda",
+		format: "lambda",
+		line:   "2024-06-15T00:00:00.000Z\t8f507cfc-xmpl-4697-b07a-ac58fc914c95\tINFO\thello\tworld\n",
+		want: map[string]any{
+			"timestamp": "2024-06-15T00:00:00.000Z",
+			"requestId": "8f507cfc-xmpl-4697-b07a-ac58fc914c95",
+			"level":     "INFO",
+			"message":   "hello\tworld",
+		},
+	},
+	{
+		name:   "python",
+		format: "python",
+		line:   "[ERROR]\t2024-06-15T00:00:00.000Z\t8f507cfc-xmpl-4697-b07a-ac58fc914c95\tboom\n",
+		want: map[string]any{
+			"timestamp": "2024-06-15T00:00:00.000Z",
+			"requestId": "8f507cfc-xmpl-4697-b07a-ac58fc914c95",
+			"level":     "ERROR",
+			"message":   "boom",
+		},
+	},
+	{
+		name:   "auto",
+		format: "auto",
+		line:   "[WARNING]\t2024-06-15T00:00:00.000Z\tabc\tcareful\n",
+		want: map[string]any{
+			"timestamp": "2024-06-15T00:00:00.000Z",
+			"requestId": "abc",
+			"level":     "WARNING",
+			"message":   "careful",
+		},
+	},
+	{
+		name:    "regexp",
+		format:  "regexp",
+		pattern: `^(?P<level>[A-Z]+) (?P<message>.*)$`,
+		line:    "DEBUG hello world\n",
+		want:    map[string]any{"level": "DEBUG", "message": "hello world"},
+	},
+	{
+		name:    "regexp not matched",
+		format:  "regexp",
+		pattern: `^(?P<level>[A-Z]+) (?P<message>.*)$`,
+		line:    "hello\n",
+		want:    map[string]any{"message": "hello"},
+	},
+	{
+		name:   "json object is passed",
+		format: "logfmt",
+		line:   `{"level":"info","n":1}` + "\n",
+		want:   map[string]any{"level": "info", "n": float64(1)},
+	},
+}
+
+func TestParseProcessor(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range parseTests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := firetap.NewProcessor(firetap.ProcessorConfig{Type: "parse", Format: tt.format, Pattern: tt.pattern})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec, ok := p.Process(ctx, firetap.Record{Data: []byte(tt.line)})
+			if !ok {
+				t.Fatal("record is dropped")
+			}
+			if n := len(rec.Data); n == 0 || rec.Data[n-1] != '\n' {
+				t.Errorf("record must end with a newline: %q", rec.Data)
+			}
+			var got map[string]any
+			if err := json.Unmarshal(rec.Data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected fields: %v", got)
+			}
+		})
+	}
+}
+
+func TestParseProcessorInvalid(t *testing.T) {
+	for _, cfg := range []firetap.ProcessorConfig{
+		{Type: "parse", Format: "unknown"},
+		{Type: "parse", Format: "regexp", Pattern: `^\w+$`},
+		{Type: "parse", Format: "regexp", Pattern: `(?P<x>`},
+	} {
+		if _, err := firetap.NewProcessor(cfg); err == nil {
+			t.Errorf("error expected for %#v", cfg)
+		}
+	}
+}
+
+func TestParseProcessorTimestamp(t *testing.T) {
+	p, err := firetap.NewProcessor(firetap.ProcessorConfig{Type: "parse", Format: "lambda"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := "2024-06-15T00:00:00.123Z\tabc\tINFO\thello\n"
+	rec, _ := p.Process(context.Background(), firetap.Record{Time: time.Now(), Data: []byte(line)})
+	if want := time.Date(2024, 6, 15, 0, 0, 0, 123000000, time.UTC); !rec.Time.Equal(want) {
+		t.Errorf("unexpected time: %s", rec.Time)
+	}
+}
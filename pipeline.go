@@ -0,0 +1,255 @@
+package firetap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Processor processes a record. It returns false to drop the record.
+type Processor interface {
+	Process(ctx context.Context, rec Record) (Record, bool)
+}
+
+// NewProcessor creates a Processor from the configuration.
+func NewProcessor(cfg ProcessorConfig) (Processor, error) {
+	switch cfg.Type {
+	case processorTypeFilter:
+		return newFilter(cfg.FilterConfig)
+	case processorTypeSample:
+		return sampler(cfg.Rate), nil
+	case processorTypeParse:
+		return newParser(cfg)
+	case processorTypeJQ:
+		return newTransform(cfg)
+	default:
+		return nil, fmt.Errorf("unknown processor type: %s", cfg.Type)
+	}
+}
+
+// filter passes the records matching include and not matching exclude.
+type filter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+func newFilter(cfg FilterConfig) (*filter, error) {
+	f := &filter{}
+	var err error
+	if cfg.Include != "" {
+		if f.include, err = regexp.Compile(cfg.Include); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Exclude != "" {
+		if f.exclude, err = regexp.Compile(cfg.Exclude); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *filter) Process(_ context.Context, rec Record) (Record, bool) {
+	if f.include != nil && !f.include.Match(rec.Data) {
+		return rec, false
+	}
+	if f.exclude != nil && f.exclude.Match(rec.Data) {
+		return rec, false
+	}
+	return rec, true
+}
+
+// sampler passes the records at the rate (0-1).
+type sampler float64
+
+func (s sampler) Process(_ context.Context, rec Record) (Record, bool) {
+	return rec, rand.Float64() < float64(s)
+}
+
+// Pipeline passes the records through the processors to the outputs.
+// It implements the Sender interface.
+//
+// The processors and the filters of the outputs can be replaced by Reload
+// without stopping the pipeline.
+type Pipeline struct {
+	state   atomic.Pointer[pipelineState]
+	outputs []*pipelineOutput
+}
+
+// pipelineState is the replaceable part of Pipeline.
+type pipelineState struct {
+	processors []Processor
+	filters    []*filter // for each output. nil passes all
+}
+
+type pipelineOutput struct {
+	name   string
+	filter *filter // configured statically
+	sender *LogSender
+}
+
+func NewPipeline(ctx context.Context, cfg *Config) (*Pipeline, error) {
+	return newPipeline(ctx, cfg, nil)
+}
+
+// NewDryRunPipeline creates a Pipeline that writes the records to w instead of sending them.
+// Each line is "<output name>\t<stream name>\t<record>".
+func NewDryRunPipeline(ctx context.Context, cfg *Config, w io.Writer) (*Pipeline, error) {
+	return newPipeline(ctx, cfg, &dryRunWriter{w: w})
+}
+
+func newPipeline(ctx context.Context, cfg *Config, dryRun *dryRunWriter) (*Pipeline, error) {
+	p := &Pipeline{}
+	for _, oc := range cfg.Outputs {
+		out := &pipelineOutput{name: oc.Name}
+		if oc.Filter != nil {
+			f, err := newFilter(*oc.Filter)
+			if err != nil {
+				return nil, fmt.Errorf("output %s: %w", oc.Name, err)
+			}
+			out.filter = f
+		}
+		sender, err := newSender(ctx, oc, dryRun)
+		if err != nil {
+			return nil, fmt.Errorf("output %s: %w", oc.Name, err)
+		}
+		out.sender = sender
+		p.outputs = append(p.outputs, out)
+	}
+	if err := p.Reload(&ReloadableConfig{Processors: cfg.Processors}); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload replaces the processors and the routes atomically.
+// Without processors, the current processors are kept.
+// The outputs not in the routes use the filters in the static configuration.
+func (p *Pipeline) Reload(rc *ReloadableConfig) error {
+	st := &pipelineState{}
+	if rc.Processors == nil {
+		if cur := p.state.Load(); cur != nil {
+			st.processors = cur.processors
+		}
+	}
+	for i, pc := range rc.Processors {
+		proc, err := NewProcessor(pc)
+		if err != nil {
+			return fmt.Errorf("processors[%d]: %w", i, err)
+		}
+		st.processors = append(st.processors, proc)
+	}
+	for name := range rc.Routes {
+		if !slices.ContainsFunc(p.outputs, func(out *pipelineOutput) bool { return out.name == name }) {
+			return fmt.Errorf("routes.%s: no such output", name)
+		}
+	}
+	for _, out := range p.outputs {
+		f := out.filter
+		if route, ok := rc.Routes[out.name]; ok {
+			var err error
+			if f, err = newFilter(route); err != nil {
+				return fmt.Errorf("routes.%s: %w", out.name, err)
+			}
+		}
+		st.filters = append(st.filters, f)
+	}
+	p.state.Store(st)
+	return nil
+}
+
+func (p *Pipeline) Send(ctx context.Context, rec Record) error {
+	st := p.state.Load()
+	for _, proc := range st.processors {
+		var ok bool
+		if rec, ok = proc.Process(ctx, rec); !ok {
+			metrics.Filtered.Add(1)
+			return nil
+		}
+	}
+	var errs []error
+	for i, out := range p.outputs {
+		if f := st.filters[i]; f != nil {
+			if _, ok := f.Process(ctx, rec); !ok {
+				continue
+			}
+		}
+		if err := out.sender.Send(ctx, rec); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Pipeline) Flush(ctx context.Context) error {
+	var errs []error
+	for _, out := range p.outputs {
+		if err := out.sender.Flush(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Len returns the number of records in the buffers of all outputs.
+func (p *Pipeline) Len() int {
+	var n int
+	for _, out := range p.outputs {
+		n += out.sender.Len()
+	}
+	return n
+}
+
+// Status returns the status of all outputs.
+func (p *Pipeline) Status() []SinkStatus {
+	st := make([]SinkStatus, 0, len(p.outputs))
+	for _, out := range p.outputs {
+		st = append(st, out.sender.Status())
+	}
+	return st
+}
+
+// Check checks the destinations of all outputs.
+func (p *Pipeline) Check(ctx context.Context) error {
+	var errs []error
+	for _, out := range p.outputs {
+		if err := out.sender.Check(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("output %s: %w", out.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Destination returns the names of the outputs.
+func (p *Pipeline) Destination() string {
+	names := make([]string, 0, len(p.outputs))
+	for _, out := range p.outputs {
+		names = append(names, out.name)
+	}
+	return strings.Join(names, ",")
+}
+
+// dryRunWriter writes the records of the outputs in the dry run mode.
+type dryRunWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (d *dryRunWriter) write(name, stream string, records []Record) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range records {
+		if _, err := fmt.Fprintf(d.w, "%s\t%s\t%s\n", name, stream, bytes.TrimRight(r.Data, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,32 +1,65 @@
 package firetap
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"strings"
 	"sync"
+	"time"
 
 	slogcontext "github.com/PumpkinSeed/slog-context"
 )
 
 type Receiver struct {
-	Endpoint string
+	Endpoint   string
+	TagRecords bool
+	Pprof      bool
+
+	// Types are the telemetry types passed to the sender. The default is "function" only.
+	Types []string
+
+	// TimestampField is the field name to add the time of the event to the function records.
+	TimestampField string
+
+	// IDField is the field name to add the record ID, the sandbox ID and the sequence number to the function records.
+	// The sequence number is stamped before the processors, so the records dropped by them are gaps of the sequence.
+	IDField string
+
+	// TraceContext adds "trace_id" and "span_id" of the invocation to the function records.
+	// The invocation is identified by the request ID set by the wrapper, otherwise by the last platform.start.
+	TraceContext bool
+
+	// InvocationMetrics receives the platform.report events regardless of Types.
+	InvocationMetrics *InvocationMetrics
+
+	// Spans receives the spans of the platform events regardless of Types.
+	Spans *SpanExporter
+
+	traces traceContexts
+	srv    *http.Server
+	mu     sync.Mutex
 }
 
-func NewReceiver(ctx context.Context) (*Receiver, error) {
+func NewReceiver(ctx context.Context, opt *Option, cfg *Config) (*Receiver, error) {
 	receiver := &Receiver{
-		Endpoint: fmt.Sprintf("http://sandbox.localdomain:%d", listenPort),
+		Endpoint:   fmt.Sprintf("http://sandbox.localdomain:%d", listenPort),
+		TagRecords: cfg.Inputs.TagRecords,
+		Pprof:      opt.Pprof,
+		Types:      cfg.Inputs.Types,
+
+		TimestampField: cfg.Inputs.TimestampField,
+		IDField:        cfg.Inputs.IDField,
+		TraceContext:   cfg.Inputs.TraceContext,
 	}
 	return receiver, nil
 }
 
-func (r *Receiver) Run(ctx context.Context, sender *LogSender) error {
+func (r *Receiver) Run(ctx context.Context, sender Sender) error {
 	ctx = slogcontext.WithValue(ctx, "component", "receiver")
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", listenPort))
@@ -35,69 +68,120 @@ func (r *Receiver) Run(ctx context.Context, sender *LogSender) error {
 	}
 	slog.InfoContext(ctx, "receiver is listening", "addr", listener.Addr())
 
-	m := http.NewServeMux()
-	m.HandleFunc("/", handleTelemetry(sender))
-	srv := http.Server{Handler: m}
+	srv := &http.Server{Handler: r.Handler(sender)}
+	r.mu.Lock()
+	r.srv = srv
+	r.mu.Unlock()
 
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
 		<-ctx.Done()
-		log.Println("shutting down receiver")
-		srv.Shutdown(ctx)
+		// usually the receiver has been already shut down by the shutdown sequence
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		r.Shutdown(ctx)
 	}()
 	if err := srv.Serve(listener); err != nil {
 		if err != http.ErrServerClosed {
 			return fmt.Errorf("failed to serve: %w", err)
 		}
 	}
-	wg.Wait()
 	return nil
 }
 
-func handleTelemetry(sender Sender) func(w http.ResponseWriter, r *http.Request) {
+// Shutdown stops accepting new requests and waits for the in-flight requests until ctx is done.
+func (r *Receiver) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	srv := r.srv
+	r.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	slog.InfoContext(ctx, "shutting down receiver")
+	return srv.Shutdown(ctx)
+}
+
+// Handler returns the http.Handler of the receiver.
+//
+//	/              receives the telemetry
+//	/healthz       returns 200 OK
+//	/stats         returns the counters and the status of the sink in JSON
+//	/debug/pprof/  serves net/http/pprof (when Pprof is enabled)
+func (r *Receiver) Handler(sender Sender) http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc("/", r.handleTelemetry(sender))
+	m.HandleFunc("/healthz", handleHealthz)
+	m.HandleFunc("/stats", handleStats(sender))
+	if r.Pprof {
+		m.HandleFunc("/debug/pprof/", pprof.Index)
+		m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return m
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// Stats represents the response of /stats.
+type Stats struct {
+	Metrics MetricsSnapshot `json:"metrics"`
+	Sinks   []SinkStatus    `json:"sinks,omitempty"`
+}
+
+func handleStats(sender Sender) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := slogcontext.WithValue(r.Context(), "component", "handler")
-		if r.Method != http.MethodPost {
+		stats := Stats{
+			Metrics: metrics.Snapshot(),
+		}
+		if sr, ok := sender.(interface{ Status() []SinkStatus }); ok {
+			stats.Sinks = sr.Status()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
+
+// accepts reports whether the telemetry type is passed to the sender.
+// A type matches to its category, e.g. "platform" matches "platform.start".
+func (r *Receiver) accepts(typ string) bool {
+	types := r.Types
+	if len(types) == 0 {
+		types = []string{"function"}
+	}
+	for _, t := range types {
+		if typ == t || strings.HasPrefix(typ, t+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Receiver) handleTelemetry(sender Sender) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := slogcontext.WithValue(req.Context(), "component", "handler")
+		if req.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		dec := json.NewDecoder(r.Body)
-		events := []TelemetryEvent{}
-		if err := dec.Decode(&events); err != nil {
+		// the events decoded before an error are already passed to the sender,
+		// and they are flushed with the next request
+		if _, _, err := r.process(ctx, sender, json.NewDecoder(req.Body)); err != nil {
 			slog.ErrorContext(ctx, "failed to decode request body", "error", err)
 			http.Error(w, "failed to decode request body", http.StatusBadRequest)
 			return
 		}
-		slog.InfoContext(ctx, "telemetry received", "events", len(events))
-		var sent, ignored int
-		for _, event := range events {
-			slog.DebugContext(ctx, "telemetry received", "time", event.Time, "type", event.Type)
-			if event.Record == nil {
-				slog.WarnContext(ctx, "event record is empty")
-				ignored++
-				continue
-			}
-			record := event.Record
-			switch event.Type {
-			case "function":
-				if b, err := restoreRecode(&record); err != nil {
-					slog.WarnContext(ctx, "failed to restore record", "error", err, "record", string(record))
-				} else {
-					if err := sender.Send(ctx, b); err != nil {
-						slog.WarnContext(ctx, "failed to send record", "error", err)
-					} else {
-						sent++
-					}
-				}
-			default:
-				ignored++
-				// ignore unknown telemetry type
-				// logger.Warn("unknown telemetry type", "type", event.Type, "record", string(record))
+		if m := r.InvocationMetrics; m != nil {
+			if err := m.flush(ctx); err != nil {
+				slog.WarnContext(ctx, "failed to flush invocation metrics", "error", err)
 			}
 		}
-		slog.InfoContext(ctx, "logs sent", "sent", sent, "ignored", ignored)
+		if e := r.Spans; e != nil {
+			e.kick()
+		}
 		if err := sender.Flush(ctx); err != nil {
 			slog.ErrorContext(ctx, "failed to flush", "error", err)
 			http.Error(w, "failed to flush", http.StatusInternalServerError)
@@ -105,33 +189,177 @@ func handleTelemetry(sender Sender) func(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// process decodes a JSON array of the events from dec and passes them to the sender
+// one by one as they are decoded, without holding the whole array.
+//
+// The records are restored into the buffers reused for each event, so the data of
+// the records passed to the sender is valid only during Send (see Sender).
+func (r *Receiver) process(ctx context.Context, sender Sender, dec *json.Decoder) (sent, ignored int, err error) {
+	var received int
+	defer func() {
+		slog.InfoContext(ctx, "logs sent", "events", received, "sent", sent, "ignored", ignored)
+		metrics.Received.Add(int64(received))
+		metrics.Sent.Add(int64(sent))
+		metrics.Ignored.Add(int64(ignored))
+	}()
+	if tok, err := dec.Token(); err != nil {
+		return 0, 0, err
+	} else if tok == nil {
+		return 0, 0, nil // null
+	} else if tok != json.Delim('[') {
+		return 0, 0, fmt.Errorf("events must be an array: %v", tok)
+	}
+	buf := getRecordBuffer()
+	defer putRecordBuffer(buf)
+	var event TelemetryEvent
+	for dec.More() {
+		// reuse the record of the previous event
+		event = TelemetryEvent{Record: event.Record[:0]}
+		if err := dec.Decode(&event); err != nil {
+			return sent, ignored, err
+		}
+		received++
+		switch r.processEvent(ctx, sender, &event, buf) {
+		case eventSent:
+			sent++
+		case eventIgnored:
+			ignored++
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return sent, ignored, err
+	}
+	return sent, ignored, nil
+}
+
+type eventResult int
+
+const (
+	eventSent eventResult = iota
+	eventIgnored
+	eventDropped
+)
+
+// processEvent restores the record of the event into buf and passes it to the sender.
+func (r *Receiver) processEvent(ctx context.Context, sender Sender, event *TelemetryEvent, buf *recordBuffer) eventResult {
+	slog.DebugContext(ctx, "telemetry received", "time", event.Time, "type", event.Type)
+	if len(event.Record) == 0 {
+		slog.WarnContext(ctx, "event record is empty")
+		return eventIgnored
+	}
+	switch event.Type {
+	case "platform.start", "platform.runtimeDone":
+		if r.tracksTraces() {
+			r.traces.observePlatform(event.Type, event.Record)
+		}
+	case "platform.report":
+		if r.InvocationMetrics != nil {
+			r.InvocationMetrics.observe(ctx, event.Timestamp(), event.Record)
+		}
+	}
+	if r.Spans != nil && strings.HasPrefix(event.Type, "platform.") {
+		r.Spans.observe(ctx, event.Type, event.Record, &r.traces)
+	}
+	if !r.accepts(event.Type) {
+		return eventIgnored
+	}
+	ts := event.Timestamp()
+	var b []byte
+	var err error
+	switch event.Type {
+	case "function":
+		var tags []recordTag
+		if r.TimestampField != "" {
+			tags = append(tags, recordTag{Key: r.TimestampField, Value: ts.Format(time.RFC3339Nano)})
+		}
+		if r.IDField != "" {
+			tags = append(tags, recordTag{Key: r.IDField, Value: event.meta(ts)})
+		}
+		if r.TraceContext {
+			if tc, ok := r.traces.get(event.RequestID); ok {
+				tags = append(tags, recordTag{Key: "trace_id", Value: tc.TraceID})
+				if tc.SpanID != "" {
+					tags = append(tags, recordTag{Key: "span_id", Value: tc.SpanID})
+				}
+			}
+		}
+		// the stream of the wrapper is always tagged to tell stderr from stdout
+		tags = append(tags, event.tags(r.TagRecords)...)
+		b, err = buf.restore(event.Record, tags)
+	default:
+		// other types are passed as the whole event
+		if b, err = json.Marshal(event); err == nil {
+			b = append(b, '\n')
+		}
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "failed to restore record", "error", err, "record", string(event.Record))
+		metrics.Dropped.Add(1)
+		return eventDropped
+	}
+	if err := sender.Send(ctx, Record{Time: ts, Data: b}); err != nil {
+		slog.WarnContext(ctx, "failed to send record", "error", err)
+		metrics.Dropped.Add(1)
+		return eventDropped
+	}
+	return eventSent
+}
+
 // TelemetryEvent represents an inbound Telemetry API message
 // https://docs.aws.amazon.com/lambda/latest/dg/telemetry-api.html#telemetry-api-messages
 type TelemetryEvent struct {
 	Time   string          `json:"time"`
 	Type   string          `json:"type"`
 	Record json.RawMessage `json:"record"`
+
+	// Stream, RequestID, ID and Seq are set by the wrapper.
+	// They are not a part of the Telemetry API.
+	Stream    string `json:"stream,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	ID        string `json:"id,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"`
+}
+
+// Timestamp returns the time of the event with the precision given by the platform (milliseconds)
+// or the wrapper (nanoseconds). If the time is invalid, it returns the current time.
+func (e *TelemetryEvent) Timestamp() time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, e.Time); err == nil {
+		return t
+	}
+	return time.Now()
 }
 
-var bufPool = sync.Pool{
-	New: func() interface{} {
-		return new(bytes.Buffer)
-	},
+// meta returns the ID and the sequence number of the event.
+// The wrapper stamps them before posting, so the events re-posted by the wrapper keep them.
+// The sequence of the wrapper is distinguished by the sandbox ID with the "wrapper" suffix.
+func (e *TelemetryEvent) meta(ts time.Time) recordMeta {
+	if e.ID != "" {
+		return recordMeta{ID: e.ID, Sandbox: sandboxID() + "-wrapper", Seq: e.Seq}
+	}
+	return recordMeta{ID: newRecordID(ts), Sandbox: sandboxID(), Seq: recordSeq.Add(1)}
 }
 
-func restoreRecode(b *json.RawMessage) ([]byte, error) {
-	var s string
-	if err := json.Unmarshal(*b, &s); err == nil {
-		if !strings.HasSuffix(s, "\n") {
-			s += "\n"
-		}
-		return []byte(s), nil
+// tags returns the tags of the fields set by the wrapper.
+// The request ID is tagged only with requestID.
+func (e *TelemetryEvent) tags(requestID bool) []recordTag {
+	var tags []recordTag
+	if e.Stream != "" {
+		tags = append(tags, recordTag{Key: "stream", Value: e.Stream})
 	}
-	buf := bufPool.Get().(*bytes.Buffer)
-	defer bufPool.Put(buf)
-	if err := json.Compact(buf, *b); err != nil {
-		return nil, err
+	if requestID && e.RequestID != "" {
+		tags = append(tags, recordTag{Key: "requestId", Value: e.RequestID})
 	}
-	buf.WriteByte('\n')
-	return buf.Bytes(), nil
+	return tags
+}
+
+// ObserveInvoke tracks the trace context of the invocation by the INVOKE event.
+func (r *Receiver) ObserveInvoke(ev *ExtensionEvent) {
+	if r.tracksTraces() {
+		r.traces.observeInvoke(ev)
+	}
+}
+
+// tracksTraces reports whether the trace contexts of the invocations are needed.
+func (r *Receiver) tracksTraces() bool {
+	return r.TraceContext || r.Spans != nil
 }
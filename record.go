@@ -0,0 +1,295 @@
+package firetap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// maxPooledRecordBuffer is the capacity of the record buffers to be returned to the pool.
+// The buffers grown by huge records are left to GC.
+const maxPooledRecordBuffer = 1024 * 1024
+
+// recordBuffer is the scratch space to restore the records of a request.
+// It is reused for each record, so the restored data is valid until the next record.
+type recordBuffer struct {
+	restored []byte
+	tagged   []byte
+}
+
+var recordBufferPool = sync.Pool{
+	New: func() any {
+		return new(recordBuffer)
+	},
+}
+
+func getRecordBuffer() *recordBuffer {
+	return recordBufferPool.Get().(*recordBuffer)
+}
+
+func putRecordBuffer(buf *recordBuffer) {
+	if cap(buf.restored) > maxPooledRecordBuffer || cap(buf.tagged) > maxPooledRecordBuffer {
+		return
+	}
+	recordBufferPool.Put(buf)
+}
+
+// restore restores the record of the function and adds the tags to it.
+// The returned slice refers to buf.
+func (buf *recordBuffer) restore(raw []byte, tags []recordTag) ([]byte, error) {
+	var err error
+	if buf.restored, err = appendRecord(buf.restored[:0], raw); err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 {
+		return buf.restored, nil
+	}
+	buf.tagged = appendTagged(buf.tagged[:0], buf.restored, tags)
+	return buf.tagged, nil
+}
+
+// appendRecord appends the log line restored from the record of the Telemetry API to dst.
+// A JSON string is unquoted, and the other values (objects) are compacted into a line.
+func appendRecord(dst []byte, raw []byte) ([]byte, error) {
+	if len(raw) > 0 && raw[0] == '"' {
+		start := len(dst)
+		var ok bool
+		if dst, ok = appendUnquoted(dst, raw); !ok {
+			return dst[:start], fmt.Errorf("invalid string record")
+		}
+		if len(dst) == start || dst[len(dst)-1] != '\n' {
+			dst = append(dst, '\n')
+		}
+		return dst, nil
+	}
+	buf := bytes.NewBuffer(dst)
+	if err := json.Compact(buf, raw); err != nil {
+		return dst, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// appendUnquoted appends the JSON string literal s unquoted to dst, same as json.Unmarshal.
+func appendUnquoted(dst, s []byte) ([]byte, bool) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return dst, false
+	}
+	s = s[1 : len(s)-1]
+	for i := 0; i < len(s); {
+		start := i
+		for i < len(s) && s[i] != '\\' && s[i] != '"' && s[i] >= ' ' && s[i] < utf8.RuneSelf {
+			i++
+		}
+		dst = append(dst, s[start:i]...)
+		if i == len(s) {
+			break
+		}
+		switch c := s[i]; {
+		case c == '\\':
+			if i+1 == len(s) {
+				return dst, false
+			}
+			switch e := s[i+1]; e {
+			case '"', '\\', '/':
+				dst = append(dst, e)
+			case 'b':
+				dst = append(dst, '\b')
+			case 'f':
+				dst = append(dst, '\f')
+			case 'n':
+				dst = append(dst, '\n')
+			case 'r':
+				dst = append(dst, '\r')
+			case 't':
+				dst = append(dst, '\t')
+			case 'u':
+				r := getu4(s[i:])
+				if r < 0 {
+					return dst, false
+				}
+				i += 6
+				if utf16.IsSurrogate(r) {
+					if dec := utf16.DecodeRune(r, getu4(s[i:])); dec != unicode.ReplacementChar {
+						i += 6
+						dst = utf8.AppendRune(dst, dec)
+						continue
+					}
+					r = unicode.ReplacementChar
+				}
+				dst = utf8.AppendRune(dst, r)
+				continue
+			default:
+				return dst, false
+			}
+			i += 2
+		case c == '"' || c < ' ':
+			return dst, false
+		default:
+			r, size := utf8.DecodeRune(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				dst = utf8.AppendRune(dst, unicode.ReplacementChar)
+			} else {
+				dst = append(dst, s[i:i+size]...)
+			}
+			i += size
+		}
+	}
+	return dst, true
+}
+
+// getu4 decodes \uXXXX from the beginning of s, returning the hex value, or -1.
+func getu4(s []byte) rune {
+	if len(s) < 6 || s[0] != '\\' || s[1] != 'u' {
+		return -1
+	}
+	r, err := strconv.ParseUint(string(s[2:6]), 16, 16)
+	if err != nil {
+		return -1
+	}
+	return rune(r)
+}
+
+type recordTag struct {
+	Key   string
+	Value any
+}
+
+// appendTagged appends the line with the tags to dst.
+// A JSON object line gets the tags as fields, and the other lines (including a text
+// line starting with "{") are wrapped into a JSON object with the "message" field.
+// A tag is skipped when the object already has the field, so the field of the record wins.
+func appendTagged(dst, line []byte, tags []recordTag) []byte {
+	body := bytes.TrimSuffix(line, []byte("\n"))
+	isObject := len(body) > 0 && body[0] == '{' && json.Valid(body)
+	dst = append(dst, '{')
+	start := len(dst)
+	for _, t := range tags {
+		if isObject && hasObjectKey(body, t.Key) || !isObject && t.Key == "message" {
+			continue
+		}
+		if len(dst) > start {
+			dst = append(dst, ',')
+		}
+		dst = appendJSONString(dst, t.Key)
+		dst = append(dst, ':')
+		dst = appendTagValue(dst, t.Value)
+	}
+	if isObject {
+		if rest := bytes.TrimSpace(body[1:]); len(dst) > start && len(rest) > 0 && rest[0] != '}' {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, body[1:]...)
+	} else {
+		if len(dst) > start {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, `"message":`...)
+		dst = appendJSONString(dst, body)
+		dst = append(dst, '}')
+	}
+	return append(dst, '\n')
+}
+
+// hasObjectKey reports whether the valid JSON object obj has the top-level key.
+func hasObjectKey(obj []byte, key string) bool {
+	if !bytes.Contains(obj, []byte(key)) && bytes.IndexByte(obj, '\\') < 0 {
+		return false // fast path: the key can't be in obj unless it is escaped
+	}
+	dec := json.NewDecoder(bytes.NewReader(obj))
+	if _, err := dec.Token(); err != nil {
+		return false
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		if k, _ := t.(string); k == key {
+			return true
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+func appendTagValue(dst []byte, v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return appendJSONString(dst, v)
+	case recordMeta:
+		dst = append(dst, `{"id":`...)
+		dst = appendJSONString(dst, v.ID)
+		dst = append(dst, `,"sandbox":`...)
+		dst = appendJSONString(dst, v.Sandbox)
+		dst = append(dst, `,"seq":`...)
+		dst = strconv.AppendUint(dst, v.Seq, 10)
+		return append(dst, '}')
+	default:
+		b, _ := json.Marshal(v)
+		return append(dst, b...)
+	}
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s quoted as a JSON string to dst, same as json.Marshal.
+func appendJSONString[T []byte | string](dst []byte, s T) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= ' ' && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		n := min(len(s)-i, utf8.UTFMax)
+		r, size := utf8.DecodeRuneInString(string(s[i : i+n]))
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
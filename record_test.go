@@ -0,0 +1,159 @@
+package firetap_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fujiwara/firetap"
+)
+
+var testStrings = []string{
+	"",
+	"hello",
+	"hello\n",
+	"tab\tand\r\nnewline",
+	`quote " and backslash \ and slash /`,
+	"<html> & </html>",
+	"\x00\x01\x1f\b\f",
+	"日本語 emoji 🍣",
+	"separators    ",
+	"invalid \xff utf-8 \xe6\x97",
+	`{"level":"INFO","message":"json in text"}`,
+}
+
+func TestAppendRecord(t *testing.T) {
+	raws := []string{
+		`"日本🍣"`,                       // surrogate pair
+		`"lone \ud83c surrogate"`,     // lone surrogate
+		`"\ud83cA broken pair"`,       // high surrogate followed by a non-surrogate
+		`"escaped \/ \b \f \" \\ \t"`, // all short escapes
+		"\"raw invalid \xff\"",
+	}
+	for _, s := range testStrings {
+		b, _ := json.Marshal(s)
+		raws = append(raws, string(b))
+	}
+	for _, raw := range raws {
+		var want string
+		if err := json.Unmarshal([]byte(raw), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(want, "\n") {
+			want += "\n"
+		}
+		got, err := firetap.AppendRecord([]byte("prefix"), []byte(raw))
+		if err != nil {
+			t.Errorf("%s: %s", raw, err)
+			continue
+		}
+		if string(got) != "prefix"+want {
+			t.Errorf("%s: got %q, want %q", raw, got, "prefix"+want)
+		}
+	}
+
+	got, err := firetap.AppendRecord(nil, []byte("{\n  \"a\": 1,\n  \"b\": [1, 2]\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != `{"a":1,"b":[1,2]}`+"\n" {
+		t.Errorf("object is not compacted: %q", got)
+	}
+	for _, raw := range []string{`"unterminated`, `"bad \x escape"`, `{"a":}`} {
+		if _, err := firetap.AppendRecord(nil, []byte(raw)); err == nil {
+			t.Errorf("%s: must be an error", raw)
+		}
+	}
+}
+
+func TestAppendJSONString(t *testing.T) {
+	for _, s := range testStrings {
+		// compare the decoded strings, because the escapes may differ between the versions of encoding/json
+		b := firetap.AppendJSONString([]byte("prefix"), s)
+		if !bytes.HasPrefix(b, []byte("prefix")) {
+			t.Fatalf("prefix is lost: %s", b)
+		}
+		var got, want string
+		if err := json.Unmarshal(b[len("prefix"):], &got); err != nil {
+			t.Errorf("%q: %s", b, err)
+			continue
+		}
+		m, _ := json.Marshal(s)
+		json.Unmarshal(m, &want)
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if bytes.ContainsAny(b, "<>&\n") {
+			t.Errorf("not escaped: %q", b)
+		}
+	}
+}
+
+func TestHandleTelemetryStream(t *testing.T) {
+	sender := &testLogSender{}
+	h := firetap.HandleTelemetry(sender, false)
+
+	// the events before the broken one are sent
+	body := `[{"time":"2024-06-15T00:00:00.000Z","type":"function","record":"foo"},` +
+		`{"time":"2024-06-15T00:00:00.001Z","type":"function","record":{"bar":1}},` +
+		`{"time":"2024-06-15T00:00:00.002Z","type":"function","record":`
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status: %d", w.Code)
+	}
+	if got := sender.String(); got != "foo\n"+`{"bar":1}`+"\n" {
+		t.Errorf("unexpected records: %q", got)
+	}
+
+	for _, body := range []string{`{"type":"function"}`, `"foo"`, ``} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: unexpected status: %d", body, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`null`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("null: unexpected status: %d", w.Code)
+	}
+}
+
+func TestSenderOwnsRecordData(t *testing.T) {
+	f := &fakeFirehose{down: true}
+	sender := newFakeFirehoseSender(t, f, firetap.OutputConfig{})
+
+	ctx := context.Background()
+	var want []string
+	buf := make([]byte, 0, 64)
+	send := func(from, to int) {
+		for i := from; i < to; i++ {
+			// the caller reuses the buffer
+			buf = fmt.Appendf(buf[:0], "record %d %s\n", i, strings.Repeat("x", i))
+			want = append(want, string(buf))
+			if err := sender.Send(ctx, firetap.Record{Data: buf}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send(0, 50)
+	// the failed records are kept in the buffer
+	if err := sender.Flush(ctx); err == nil {
+		t.Fatal("flush must fail")
+	}
+	send(50, 100)
+	f.set(false)
+	if err := sender.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.recorded(); !slices.Equal(got, want) {
+		t.Errorf("records are corrupted:\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,46 @@
+package firetap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recordSeq is the sequence number of the records in the process.
+var recordSeq atomic.Uint64
+
+// sandboxID identifies the execution environment (sandbox) of the function.
+// The log stream name of Lambda ends with the unique ID of the sandbox,
+// like "2024/06/15/[$LATEST]8f507cfcxmpl4697b07aac58fc914c95".
+var sandboxID = sync.OnceValue(func() string {
+	name := os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME")
+	if i := strings.LastIndex(name, "]"); i >= 0 && i+1 < len(name) {
+		return name[i+1:]
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+})
+
+// recordMeta is added to the records for the consumers to dedupe and to detect gaps.
+type recordMeta struct {
+	ID      string `json:"id"`
+	Sandbox string `json:"sandbox"`
+	Seq     uint64 `json:"seq"`
+}
+
+// newRecordID returns a time-ordered unique ID in the UUID version 7 format.
+func newRecordID(t time.Time) string {
+	var u [16]byte
+	binary.BigEndian.PutUint64(u[:8], uint64(t.UnixMilli())<<16)
+	rand.Read(u[6:])
+	u[6] = u[6]&0x0f | 0x70 // version 7
+	u[8] = u[8]&0x3f | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
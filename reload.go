@@ -0,0 +1,219 @@
+package firetap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	slogcontext "github.com/PumpkinSeed/slog-context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"sigs.k8s.io/yaml"
+)
+
+// ReloadableConfig is the part of the configuration that can be changed without restarting.
+//
+//	processors:        # replaces all processors when specified
+//	  - type: sample
+//	    rate: 0.1
+//	routes:            # replaces the filter of the output by name (must exist)
+//	  errors:
+//	    include: ERROR
+type ReloadableConfig struct {
+	Processors []ProcessorConfig       `json:"processors,omitempty"`
+	Routes     map[string]FilterConfig `json:"routes,omitempty"`
+}
+
+// parseReloadableConfig decodes a YAML or JSON document strictly.
+func parseReloadableConfig(b []byte) (*ReloadableConfig, error) {
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	rc := &ReloadableConfig{}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(rc); err != nil {
+		return nil, err
+	}
+	errs := validateProcessors(rc.Processors)
+	for name, route := range rc.Routes {
+		errs = append(errs, validateFilter("routes."+name, route.Include, route.Exclude)...)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// ConfigSource fetches the reloadable configuration document.
+type ConfigSource interface {
+	Fetch(ctx context.Context) ([]byte, error)
+}
+
+// NewConfigSource creates a ConfigSource from the URL.
+//
+//	ssm:///path/to/parameter                   SSM Parameter Store
+//	appconfig://application/environment/profile  AppConfig Lambda extension
+func NewConfigSource(ctx context.Context, source string) (ConfigSource, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config source %s: %w", source, err)
+	}
+	switch u.Scheme {
+	case "ssm":
+		awsCfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		name := u.Path
+		if u.Host != "" {
+			name = u.Host + u.Path
+		}
+		return NewSSMSource(ssm.NewFromConfig(awsCfg), name), nil
+	case "appconfig":
+		port := os.Getenv("AWS_APPCONFIG_EXTENSION_HTTP_PORT")
+		if port == "" {
+			port = "2772"
+		}
+		return NewAppConfigSource("http://localhost:"+port, u.Host+u.Path)
+	default:
+		return nil, fmt.Errorf("unsupported config source: %s", source)
+	}
+}
+
+type ssmSource struct {
+	client *ssm.Client
+	name   string
+}
+
+func NewSSMSource(client *ssm.Client, name string) ConfigSource {
+	return &ssmSource{client: client, name: name}
+}
+
+func (s *ssmSource) Fetch(ctx context.Context) ([]byte, error) {
+	out, err := s.client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           &s.name,
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parameter %s: %w", s.name, err)
+	}
+	return []byte(aws.ToString(out.Parameter.Value)), nil
+}
+
+type appConfigSource struct {
+	url    string
+	client *http.Client
+}
+
+// NewAppConfigSource creates a ConfigSource for the local HTTP endpoint of the AppConfig Lambda extension.
+// path is "application/environment/profile".
+// https://docs.aws.amazon.com/appconfig/latest/userguide/appconfig-integration-lambda-extensions.html
+func NewAppConfigSource(endpoint, path string) (ConfigSource, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("appconfig path must be application/environment/profile: %s", path)
+	}
+	return &appConfigSource{
+		url: fmt.Sprintf("%s/applications/%s/environments/%s/configurations/%s",
+			endpoint, url.PathEscape(parts[0]), url.PathEscape(parts[1]), url.PathEscape(parts[2])),
+		client: &http.Client{Timeout: 3 * time.Second},
+	}, nil
+}
+
+func (s *appConfigSource) Fetch(ctx context.Context) ([]byte, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get configuration: %d %s", resp.StatusCode, string(b))
+	}
+	return b, nil
+}
+
+// Reloader polls the ConfigSource and reloads the Pipeline when the document is changed.
+type Reloader struct {
+	source   ConfigSource
+	pipeline *Pipeline
+	interval time.Duration
+
+	running   atomic.Bool
+	mu        sync.Mutex
+	lastFetch time.Time
+	last      []byte
+}
+
+func NewReloader(source ConfigSource, pipeline *Pipeline, interval time.Duration) *Reloader {
+	return &Reloader{
+		source:   source,
+		pipeline: pipeline,
+		interval: interval,
+	}
+}
+
+// Poll reloads the configuration in background if the interval has passed since the last fetch.
+// It is called on each INVOKE event, so it never blocks.
+func (r *Reloader) Poll(ctx context.Context) {
+	r.mu.Lock()
+	if time.Since(r.lastFetch) < r.interval {
+		r.mu.Unlock()
+		return
+	}
+	r.lastFetch = time.Now()
+	r.mu.Unlock()
+	if !r.running.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer r.running.Store(false)
+		if _, err := r.Reload(ctx); err != nil {
+			slog.WarnContext(ctx, "failed to reload config", "error", err)
+		}
+	}()
+}
+
+// Reload fetches the configuration and applies it. It returns true when the configuration is changed.
+// When the configuration is invalid, the current configuration is kept.
+func (r *Reloader) Reload(ctx context.Context) (bool, error) {
+	ctx = slogcontext.WithValue(ctx, "component", "reloader")
+	b, err := r.source.Fetch(ctx)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if bytes.Equal(b, r.last) {
+		slog.DebugContext(ctx, "config is not changed")
+		return false, nil
+	}
+	rc, err := parseReloadableConfig(b)
+	if err != nil {
+		return false, fmt.Errorf("invalid config: %w", err)
+	}
+	if err := r.pipeline.Reload(rc); err != nil {
+		return false, err
+	}
+	r.last = b
+	slog.InfoContext(ctx, "config reloaded", "config", rc)
+	return true, nil
+}
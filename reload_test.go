@@ -0,0 +1,144 @@
+package firetap_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/fujiwara/firetap"
+)
+
+func newTestPipeline(t *testing.T) *firetap.Pipeline {
+	t.Helper()
+	cfg, err := firetap.LoadConfig(&firetap.Option{StreamName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := firetap.NewPipeline(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestReloadAppConfig(t *testing.T) {
+	var mu sync.Mutex
+	doc := "processors:\n  - type: filter\n    exclude: DEBUG\n"
+	var requested string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requested = r.URL.Path
+		w.Write([]byte(doc))
+	}))
+	defer s.Close()
+
+	ctx := context.Background()
+	p := newTestPipeline(t)
+	source, err := firetap.NewAppConfigSource(s.URL, "app/env/profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := firetap.NewReloader(source, p, 0)
+	if changed, err := r.Reload(ctx); err != nil || !changed {
+		t.Fatalf("Reload() = (%v, %v), want (true, nil)", changed, err)
+	}
+	if requested != "/applications/app/environments/env/configurations/profile" {
+		t.Errorf("unexpected path: %s", requested)
+	}
+	p.Send(ctx, firetap.Record{Data: []byte("DEBUG foo\n")})
+	p.Send(ctx, firetap.Record{Data: []byte("INFO bar\n")})
+	if n := p.Len(); n != 1 {
+		t.Errorf("buffered records = %d, want 1", n)
+	}
+
+	if changed, err := r.Reload(ctx); err != nil || changed {
+		t.Errorf("Reload() = (%v, %v), want (false, nil)", changed, err)
+	}
+
+	// invalid config keeps the current one
+	mu.Lock()
+	doc = "processors:\n  - type: filter\n    include: \"(\"\n"
+	mu.Unlock()
+	if _, err := r.Reload(ctx); err == nil {
+		t.Error("Reload() must fail with invalid config")
+	}
+	p.Send(ctx, firetap.Record{Data: []byte("DEBUG baz\n")})
+	if n := p.Len(); n != 1 {
+		t.Errorf("buffered records = %d, want 1", n)
+	}
+}
+
+func TestReloadSSM(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct{ Name string }
+		json.NewDecoder(r.Body).Decode(&in)
+		if r.Header.Get("X-Amz-Target") != "AmazonSSM.GetParameter" || in.Name != "/firetap/config" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"Parameter": map[string]any{
+				"Name":  in.Name,
+				"Value": `{"routes":{"test":{"include":"ERROR"}}}`,
+			},
+		})
+	}))
+	defer s.Close()
+
+	ctx := context.Background()
+	client := ssm.New(ssm.Options{
+		BaseEndpoint: aws.String(s.URL),
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	})
+	p := newTestPipeline(t)
+	r := firetap.NewReloader(firetap.NewSSMSource(client, "/firetap/config"), p, 0)
+	if changed, err := r.Reload(ctx); err != nil || !changed {
+		t.Fatalf("Reload() = (%v, %v), want (true, nil)", changed, err)
+	}
+	p.Send(ctx, firetap.Record{Data: []byte("INFO foo\n")})
+	p.Send(ctx, firetap.Record{Data: []byte("ERROR bar\n")})
+	if n := p.Len(); n != 1 {
+		t.Errorf("buffered records = %d, want 1", n)
+	}
+}
+
+func TestReloadRoutesOnly(t *testing.T) {
+	cfg, err := firetap.LoadConfig(&firetap.Option{StreamName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Processors = []firetap.ProcessorConfig{{Type: "filter", FilterConfig: firetap.FilterConfig{Exclude: "DEBUG"}}}
+	ctx := context.Background()
+	p, err := firetap.NewPipeline(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Reload(&firetap.ReloadableConfig{Routes: map[string]firetap.FilterConfig{"test": {Include: "foo"}}}); err != nil {
+		t.Fatal(err)
+	}
+	p.Send(ctx, firetap.Record{Data: []byte("DEBUG foo\n")})
+	p.Send(ctx, firetap.Record{Data: []byte("INFO foo\n")})
+	p.Send(ctx, firetap.Record{Data: []byte("INFO bar\n")})
+	if n := p.Len(); n != 1 {
+		t.Errorf("the static processors must be kept: buffered records = %d, want 1", n)
+	}
+
+	if err := p.Reload(&firetap.ReloadableConfig{Routes: map[string]firetap.FilterConfig{"unknown": {Include: "foo"}}}); err == nil {
+		t.Error("routes of unknown outputs must be rejected")
+	}
+	if err := p.Reload(&firetap.ReloadableConfig{Processors: []firetap.ProcessorConfig{}}); err != nil {
+		t.Fatal(err)
+	}
+	p.Send(ctx, firetap.Record{Data: []byte("DEBUG foo\n")})
+	if n := p.Len(); n != 2 {
+		t.Errorf("empty processors must replace the processors: buffered records = %d, want 2", n)
+	}
+}
@@ -0,0 +1,109 @@
+package firetap
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	slogcontext "github.com/PumpkinSeed/slog-context"
+)
+
+const (
+	runtimeRequestIDHeader = "Lambda-Runtime-Aws-Request-Id"
+	runtimeDeadlineHeader  = "Lambda-Runtime-Deadline-Ms"
+)
+
+// Invocation represents an invocation observed by RuntimeAPIProxy.
+type Invocation struct {
+	RequestID string
+	Deadline  time.Time
+}
+
+// RuntimeAPIProxy is a proxy of the Lambda Runtime API for the child command.
+// It observes the invocation boundaries and tells them to TelemetryAPIClient.
+type RuntimeAPIProxy struct {
+	Addr string
+
+	listener net.Listener
+	upstream *url.URL
+	client   *TelemetryAPIClient
+}
+
+// NewRuntimeAPIProxy creates a proxy listening on a local port and forwarding to the upstream Runtime API (host:port).
+func NewRuntimeAPIProxy(upstream string, client *TelemetryAPIClient) (*RuntimeAPIProxy, error) {
+	u, err := url.Parse("http://" + upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid runtime API address %s: %w", upstream, err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	return &RuntimeAPIProxy{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+		upstream: u,
+		client:   client,
+	}, nil
+}
+
+func (p *RuntimeAPIProxy) Run(ctx context.Context) error {
+	ctx = slogcontext.WithValue(ctx, "component", "runtime-api-proxy")
+	slog.InfoContext(ctx, "runtime API proxy is listening", "addr", p.Addr, "upstream", p.upstream.Host)
+
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(p.upstream)
+			r.Out.Host = p.upstream.Host
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			p.observe(ctx, resp)
+			return nil
+		},
+	}
+	srv := http.Server{Handler: rp}
+	go func() {
+		<-ctx.Done()
+		slog.InfoContext(ctx, "shutting down runtime API proxy")
+		srv.Close()
+	}()
+	if err := srv.Serve(p.listener); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("failed to serve: %w", err)
+	}
+	return nil
+}
+
+// observe watches the responses of the Runtime API.
+//
+//	GET  /2018-06-01/runtime/invocation/next                  starts an invocation
+//	POST /2018-06-01/runtime/invocation/{request_id}/response ends the invocation
+//	POST /2018-06-01/runtime/invocation/{request_id}/error    ends the invocation
+func (p *RuntimeAPIProxy) observe(ctx context.Context, resp *http.Response) {
+	req := resp.Request
+	path := req.URL.Path
+	switch {
+	case req.Method == http.MethodGet && strings.HasSuffix(path, "/runtime/invocation/next"):
+		if resp.StatusCode != http.StatusOK {
+			return
+		}
+		inv := Invocation{
+			RequestID: resp.Header.Get(runtimeRequestIDHeader),
+		}
+		if ms, err := strconv.ParseInt(resp.Header.Get(runtimeDeadlineHeader), 10, 64); err == nil {
+			inv.Deadline = time.UnixMilli(ms)
+		}
+		slog.DebugContext(ctx, "invocation started", "request_id", inv.RequestID, "deadline", inv.Deadline)
+		p.client.StartInvocation(inv)
+	case req.Method == http.MethodPost && strings.Contains(path, "/runtime/invocation/") &&
+		(strings.HasSuffix(path, "/response") || strings.HasSuffix(path, "/error")):
+		slog.DebugContext(ctx, "invocation finished", "path", path, "status", resp.StatusCode)
+		p.client.EndInvocation(ctx)
+	}
+}
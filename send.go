@@ -0,0 +1,153 @@
+package firetap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	slogcontext "github.com/PumpkinSeed/slog-context"
+)
+
+const (
+	sendFormatAuto       = "auto"
+	sendFormatLines      = "lines"
+	sendFormatTelemetry  = "telemetry"
+	sendFormatDeadLetter = "dead_letter"
+
+	maxSendLineBytes = 1024 * 1024
+)
+
+// Send reads the logs from the files or stdin and sends them through the pipeline
+// same as the extension.
+func Send(ctx context.Context, opt *Option) error {
+	ctx = slogcontext.WithValue(ctx, "component", "send")
+	cfg, err := LoadConfig(opt)
+	if err != nil {
+		return err
+	}
+	rcv, err := NewReceiver(ctx, opt, cfg)
+	if err != nil {
+		return err
+	}
+	var pipeline *Pipeline
+	if opt.Send.DryRun {
+		pipeline, err = NewDryRunPipeline(ctx, cfg, os.Stdout)
+	} else {
+		pipeline, err = NewPipeline(ctx, cfg)
+	}
+	if err != nil {
+		return err
+	}
+	files := opt.Send.Files
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var total int
+	for _, name := range files {
+		n, err := sendFile(ctx, rcv, pipeline, name, opt.Send.Format)
+		total += n
+		if err != nil {
+			return fmt.Errorf("failed to send %s: %w", name, err)
+		}
+	}
+	if err := pipeline.Flush(ctx); err != nil {
+		return fmt.Errorf("failed to flush: %w", err)
+	}
+	slog.InfoContext(ctx, "sent", "records", total, "files", len(files))
+	return nil
+}
+
+func sendFile(ctx context.Context, rcv *Receiver, sender Sender, name, format string) (int, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return sendFrom(ctx, rcv, sender, r, format)
+}
+
+// sendFrom sends the logs read from r in the format.
+//
+//	lines        newline-delimited logs, each line is a record
+//	telemetry    JSON arrays of the Telemetry API events, processed same as the receiver
+//	dead_letter  entries of the file dead letter
+//	auto         telemetry if the input begins with "[", otherwise lines
+func sendFrom(ctx context.Context, rcv *Receiver, sender Sender, r io.Reader, format string) (int, error) {
+	br := bufio.NewReader(r)
+	if format == sendFormatAuto || format == "" {
+		format = sendFormatLines
+		if b, err := peekNonSpace(br); err == nil && b == '[' {
+			format = sendFormatTelemetry
+		}
+	}
+	switch format {
+	case sendFormatTelemetry:
+		var sent int
+		dec := json.NewDecoder(br)
+		for {
+			n, _, err := rcv.process(ctx, sender, dec)
+			sent += n
+			if errors.Is(err, io.EOF) {
+				return sent, nil
+			} else if err != nil {
+				return sent, fmt.Errorf("failed to decode telemetry events: %w", err)
+			}
+		}
+	case sendFormatLines, sendFormatDeadLetter:
+		var sent int
+		scanner := bufio.NewScanner(br)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxSendLineBytes)
+		var buf []byte // the sender does not retain the data
+		for scanner.Scan() {
+			line := bytes.TrimRight(scanner.Bytes(), "\r")
+			if len(line) == 0 {
+				continue
+			}
+			buf = append(append(buf[:0], line...), '\n')
+			rec := Record{Time: time.Now(), Data: buf}
+			if format == sendFormatDeadLetter {
+				var entry DeadLetterEntry
+				if err := json.Unmarshal(line, &entry); err != nil {
+					return sent, fmt.Errorf("failed to decode dead letter entry: %w", err)
+				}
+				rec = Record{Time: entry.RecordTime, Data: []byte(entry.Record)}
+				if rec.Time.IsZero() {
+					// written by an older version
+					rec.Time = entry.Time
+				}
+			}
+			if err := sender.Send(ctx, rec); err != nil {
+				return sent, err
+			}
+			sent++
+		}
+		metrics.Received.Add(int64(sent))
+		metrics.Sent.Add(int64(sent))
+		return sent, scanner.Err()
+	default:
+		return 0, fmt.Errorf("unknown format: %s", format)
+	}
+}
+
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for i := 1; ; i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			return 0, err
+		}
+		if c := b[i-1]; c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return c, nil
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package firetap_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/firetap"
+)
+
+var sendTests = []struct {
+	name   string
+	format string
+	input  string
+	want   string
+}{
+	{
+		name:   "lines",
+		format: "lines",
+		input:  "foo\r\n\n{\"bar\":1}\nbaz",
+		want:   "foo\n{\"bar\":1}\nbaz\n",
+	},
+	{
+		name:   "auto lines",
+		format: "auto",
+		input:  "foo\nbar\n",
+		want:   "foo\nbar\n",
+	},
+	{
+		name:   "telemetry",
+		format: "telemetry",
+		input: `[{"time":"2024-06-15T00:00:00.000Z","type":"function","record":"foo"}]
+[{"time":"2024-06-15T00:00:01.000Z","type":"function","record":{"bar":1}},{"time":"2024-06-15T00:00:01.000Z","type":"platform.start","record":{}}]
+`,
+		want: "foo\n{\"bar\":1}\n",
+	},
+	{
+		name:   "auto telemetry",
+		format: "auto",
+		input:  ` [{"time":"2024-06-15T00:00:00.000Z","type":"function","record":"foo"}]`,
+		want:   "foo\n",
+	},
+	{
+		name:   "dead letter",
+		format: "dead_letter",
+		input:  `{"time":"2024-06-15T00:00:00Z","stream":"s","reason":"failed","record":"foo\n"}` + "\n",
+		want:   "foo\n",
+	},
+}
+
+func TestSend(t *testing.T) {
+	for _, tt := range sendTests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &testLogSender{}
+			if _, err := firetap.SendFrom(sender, strings.NewReader(tt.input), tt.format); err != nil {
+				t.Fatal(err)
+			}
+			if sender.String() != tt.want {
+				t.Errorf("unexpected logs: %q", sender.String())
+			}
+		})
+	}
+}
+
+func TestSendDeadLetterTime(t *testing.T) {
+	sender := &testLogSender{}
+	input := `{"time":"2024-06-15T00:01:00Z","stream":"s","reason":"failed","record":"foo\n","record_time":"2024-06-15T00:00:00.123456789Z"}
+{"time":"2024-06-15T00:01:00Z","stream":"s","reason":"failed","record":"bar\n"}`
+	if _, err := firetap.SendFrom(sender, strings.NewReader(input), "dead_letter"); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 6, 15, 0, 0, 0, 123456789, time.UTC); !sender.records[0].Time.Equal(want) {
+		t.Errorf("the time of the record must be replayed: %s", sender.records[0].Time)
+	}
+	if want := time.Date(2024, 6, 15, 0, 1, 0, 0, time.UTC); !sender.records[1].Time.Equal(want) {
+		t.Errorf("the time of the entry must be used without record_time: %s", sender.records[1].Time)
+	}
+}
+
+func TestSendInvalid(t *testing.T) {
+	sender := &testLogSender{}
+	if _, err := firetap.SendFrom(sender, strings.NewReader(`[{"time":`), "telemetry"); err == nil {
+		t.Error("error expected")
+	}
+}
@@ -2,12 +2,21 @@ package firetap
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	slogcontext "github.com/PumpkinSeed/slog-context"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/firehose"
 	firehoseTypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
@@ -16,7 +25,30 @@ import (
 	"github.com/shogo82148/go-retry"
 )
 
-const maxBatchSize = 500
+const (
+	maxBatchSize      = 500
+	maxBatchBytes     = 1024 * 512
+	defaultMaxStreams = 10
+)
+
+// streamNamePattern matches the valid names of Firehose and Kinesis Data Streams.
+var streamNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+func isStreamTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// newStreamTemplate parses the stream name template like "logs-{{.tenant}}".
+// A missing field is an error, so the record goes to the fallback stream.
+func newStreamTemplate(s string) (*template.Template, error) {
+	return template.New("stream_name").
+		Option("missingkey=error").
+		Funcs(template.FuncMap{
+			"lower": strings.ToLower,
+			"upper": strings.ToUpper,
+		}).
+		Parse(s)
+}
 
 var retryPolicy = retry.Policy{
 	MinDelay: 100 * time.Millisecond,
@@ -24,112 +56,687 @@ var retryPolicy = retry.Policy{
 	MaxCount: 10,
 }
 
+// Sender sends the records.
+//
+// The caller of Send may reuse rec.Data after Send returns, so a Sender that keeps
+// the data (e.g. for batching) must copy it.
 type Sender interface {
-	Send(ctx context.Context, msg []byte) error
+	Send(ctx context.Context, rec Record) error
 	Flush(ctx context.Context) error
 }
 
+// Record is a log record passed to the Sender.
+type Record struct {
+	// Time is the time of the telemetry event.
+	Time time.Time
+	// Data is the restored log line terminated by a newline.
+	Data []byte
+}
+
 type LogSender struct {
-	streamName string
-	buf        [][]byte
-	bufSize    int
-	firehose   *firehose.Client
-	kinesis    *kinesis.Client
-	mu         sync.Mutex
+	name        string
+	streamName  string
+	streamARN   string
+	batches     map[string]*batch // by stream name
+	maxRecords  int
+	maxBytes    int
+	retryPolicy retry.Policy
+	firehose    *firehose.Client
+	kinesis     *kinesis.Client
+	deadLetter  DeadLetter
+	encoder     encoder
+
+	// circuit breakers and rate limiters by stream name
+	circuitBreaker CircuitBreakerConfig
+	rateLimit      RateLimitConfig
+	breakers       map[string]*circuitBreaker
+	limiters       map[string]*rateLimiter
+
+	// ordered puts to Kinesis one by one with SequenceNumberForOrdering.
+	ordered         bool
+	sequenceNumbers map[string]string // the last sequence number by stream name
+
+	// dryRun writes the records instead of sending them.
+	dryRun *dryRunWriter
+
+	streamTemplate *template.Template
+	fallbackStream string
+	maxStreams     int
+
+	// mu guards the maps and the status. The records of a stream are guarded by the batch,
+	// so a slow stream (e.g. waiting for the rate limit) does not block the other streams.
+	// mu may be locked while locking a batch, but not the reverse.
+	mu sync.Mutex
+
+	lastFlushAt time.Time
+	lastError   error
+}
+
+// SinkStatus represents the status of LogSender.
+type SinkStatus struct {
+	Name          string    `json:"name"`
+	StreamName    string    `json:"stream_name"`
+	Streams       []string  `json:"streams,omitempty"`
+	Type          string    `json:"type"`
+	BufferRecords int       `json:"buffer_records"`
+	BufferBytes   int       `json:"buffer_bytes"`
+	LastFlushAt   time.Time `json:"last_flush_at"`
+	LastError     string    `json:"last_error,omitempty"`
+	OpenCircuits  []string  `json:"open_circuits,omitempty"`
+}
+
+func NewSender(ctx context.Context, cfg OutputConfig) (*LogSender, error) {
+	return newSender(ctx, cfg, nil)
 }
 
-func NewSender(ctx context.Context, streamName string, dataStream bool) (*LogSender, error) {
-	awsCfg, err := config.LoadDefaultConfig(ctx)
+func newSender(ctx context.Context, cfg OutputConfig, dryRun *dryRunWriter) (*LogSender, error) {
+	dest, err := parseDestination(cfg.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	awsCfg, err := loadAWSConfig(ctx, cfg, dest)
 	if err != nil {
 		return nil, err
 	}
 	s := &LogSender{
-		streamName: streamName,
-		buf:        make([][]byte, 0, maxBatchSize),
+		name:       cfg.Name,
+		streamName: dest.name,
+		streamARN:  dest.arn,
+		batches:    make(map[string]*batch),
+		maxRecords: cfg.Batch.MaxRecords,
+		maxBytes:   cfg.Batch.MaxBytes,
+		retryPolicy: retry.Policy{
+			MinDelay: time.Duration(cfg.Retry.MinDelay),
+			MaxDelay: time.Duration(cfg.Retry.MaxDelay),
+			MaxCount: cfg.Retry.MaxCount,
+		},
+		circuitBreaker: cfg.CircuitBreaker,
+		rateLimit:      cfg.RateLimit,
+		breakers:       make(map[string]*circuitBreaker),
+		limiters:       make(map[string]*rateLimiter),
+
+		ordered:         cfg.Ordered,
+		sequenceNumbers: make(map[string]string),
+		dryRun:          dryRun,
 	}
-	if dataStream {
-		s.kinesis = kinesis.NewFromConfig(awsCfg)
-	} else {
-		s.firehose = firehose.NewFromConfig(awsCfg)
+	if dryRun != nil {
+		// the records are written before encoding
+		s.encoder = rawEncoder{}
+	} else if s.encoder, err = newEncoder(ctx, cfg); err != nil {
+		return nil, err
+	}
+	if isStreamTemplate(cfg.StreamName) {
+		if s.streamTemplate, err = newStreamTemplate(cfg.StreamName); err != nil {
+			return nil, err
+		}
+		s.fallbackStream = cfg.FallbackStream
+		s.maxStreams = cfg.MaxStreams
+	}
+	switch cfg.Type {
+	case outputTypeKinesis:
+		s.kinesis = kinesis.NewFromConfig(awsCfg, func(o *kinesis.Options) {
+			if cfg.Endpoint != "" {
+				o.BaseEndpoint = aws.String(cfg.Endpoint)
+			}
+		})
+	default:
+		s.firehose = firehose.NewFromConfig(awsCfg, func(o *firehose.Options) {
+			if cfg.Endpoint != "" {
+				o.BaseEndpoint = aws.String(cfg.Endpoint)
+			}
+		})
+	}
+	if cfg.DeadLetter != "" && dryRun == nil {
+		// the dead letter belongs to the function's own account and region
+		localCfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if s.deadLetter, err = NewDeadLetter(ctx, localCfg, cfg.DeadLetter); err != nil {
+			return nil, err
+		}
 	}
 	return s, nil
 }
 
-func (s *LogSender) Send(ctx context.Context, msg []byte) error {
-	ctx = slogcontext.WithValue(ctx, "component", "sender")
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if len(s.buf) == maxBatchSize || s.bufSize+len(msg) > 1024*512 {
-		if err := s.Flush(ctx); err != nil {
+func (s *LogSender) Send(ctx context.Context, rec Record) error {
+	// the logger context is derived only when flushing,
+	// because slogcontext.WithValue allocates for each record
+	var stream string
+	var b *batch
+	for {
+		s.mu.Lock()
+		stream = s.resolveStream(ctx, rec.Data)
+		if stream == "" {
+			s.mu.Unlock()
+			return fmt.Errorf("no stream is resolved for the record")
+		}
+		b = s.batches[stream]
+		if b == nil {
+			b = &batch{records: make([]Record, 0, s.maxRecords)}
+			s.batches[stream] = b
+		}
+		s.mu.Unlock()
+
+		b.mu.Lock()
+		if !b.removed {
+			break
+		}
+		// forgotten by Flush meanwhile
+		b.mu.Unlock()
+	}
+	defer b.mu.Unlock()
+	if len(b.records) == s.maxRecords || b.size+len(rec.Data) > s.maxBytes {
+		ctx = slogcontext.WithValue(ctx, "component", "sender")
+		if err := s.flushBatch(ctx, stream, b); err != nil {
 			return fmt.Errorf("failed to flush: %w", err)
 		}
 	}
-	s.bufSize += len(msg)
-	s.buf = append(s.buf, msg)
+	b.add(rec)
 	return nil
 }
 
 func (s *LogSender) Flush(ctx context.Context) error {
-	ctx = slogcontext.WithValue(ctx, "stream", s.streamName)
+	var errs []error
+	for stream, b := range s.streams() {
+		b.mu.Lock()
+		var err error
+		if len(b.records) == 0 && s.streamTemplate != nil {
+			// idle since the last flush
+			s.forget(stream, b)
+		} else {
+			err = s.flushBatch(ctx, stream, b)
+		}
+		b.mu.Unlock()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	err := errors.Join(errs...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err
+	if err == nil {
+		s.lastFlushAt = time.Now()
+	}
+	return err
+}
+
+// forget removes the idle stream resolved by the template, so max_streams limits the streams
+// in use, not the streams ever resolved. A stream with the circuit not closed is kept.
+// The caller must lock the batch, not s.mu.
+func (s *LogSender) forget(stream string, b *batch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cb, ok := s.breakers[stream]; ok && cb.state != circuitClosed {
+		return
+	}
+	delete(s.batches, stream)
+	delete(s.breakers, stream)
+	delete(s.limiters, stream)
+	delete(s.sequenceNumbers, stream)
+	b.removed = true
+}
+
+// streams returns the batches by stream name.
+func (s *LogSender) streams() map[string]*batch {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if len(s.buf) == 0 {
+	return maps.Clone(s.batches)
+}
+
+// flushBatch flushes the batch of the stream. The caller must lock the batch, not s.mu.
+func (s *LogSender) flushBatch(ctx context.Context, stream string, b *batch) error {
+	ctx = slogcontext.WithValue(ctx, "stream", stream)
+	if len(b.records) == 0 {
 		return nil
 	}
-	if s.kinesis != nil {
-		return s.flushToKinesis(ctx)
+	if s.dryRun != nil {
+		err := s.dryRun.write(s.name, stream, b.records)
+		b.reset()
+		return err
+	}
+	payloads, groups, err := s.encoder.encode(b.records)
+	if err != nil {
+		return s.divert(ctx, stream, b, slices.Clone(b.records), fmt.Errorf("failed to encode records: %w", err))
+	}
+	s.mu.Lock()
+	cb, limiter := s.breaker(stream), s.limiter(stream)
+	allowed, halfOpen, until := cb.allow(), cb.state == circuitHalfOpen, cb.openUntil()
+	s.mu.Unlock()
+	if !allowed {
+		slog.DebugContext(ctx, "circuit is open, skipping the flush", "records", len(b.records))
+		return s.divert(ctx, stream, b, slices.Clone(b.records), &errCircuitOpen{stream: stream, until: until})
+	}
+	policy := s.retryPolicy
+	if halfOpen {
+		// a trial flush without retries
+		policy.MaxCount = 1
+	}
+	var failedIdx []int
+	if s.kinesis != nil && s.ordered {
+		failedIdx, err = s.flushToKinesisOrdered(ctx, stream, policy, limiter, payloads)
+	} else if s.kinesis != nil {
+		failedIdx, err = s.flushToKinesis(ctx, stream, policy, limiter, payloads)
 	} else {
-		return s.flushToFirehose(ctx)
+		failedIdx, err = s.flushToFirehose(ctx, stream, policy, limiter, payloads)
+	}
+	if err == nil {
+		s.mu.Lock()
+		closed := cb.success()
+		s.mu.Unlock()
+		if closed {
+			slog.InfoContext(ctx, "circuit is closed")
+		}
+		b.reset()
+		return nil
+	}
+	// the rate limit is not a failure of the stream
+	var rl *errRateLimit
+	if !errors.As(err, &rl) {
+		s.mu.Lock()
+		opened, until := cb.failure(), cb.openUntil()
+		s.mu.Unlock()
+		if opened {
+			metrics.CircuitOpens.Add(1)
+			slog.WarnContext(ctx, "circuit is opened", "until", until, "error", err)
+		}
+	}
+	var failed []Record
+	for _, i := range failedIdx {
+		failed = append(failed, groups[i]...)
+	}
+	return s.divert(ctx, stream, b, failed, err)
+}
+
+// divert handles the records failed to send by err. They are put to the dead letter if configured,
+// otherwise they are kept in the buffer to retry at the next flush.
+func (s *LogSender) divert(ctx context.Context, stream string, b *batch, failed []Record, err error) error {
+	if s.deadLetter == nil {
+		// keep the failed records to retry at the next flush
+		b.keep(failed)
+		return err
+	}
+
+	// the main buffer moves on regardless of the result of the dead letter
+	b.reset()
+	if dlErr := s.deadLetter.Put(ctx, newDeadLetterEntries(stream, failed, err)); dlErr != nil {
+		metrics.Dropped.Add(int64(len(failed)))
+		return fmt.Errorf("failed to put %d records to dead letter: %w (reason: %s)", len(failed), dlErr, err)
+	}
+	metrics.DeadLettered.Add(int64(len(failed)))
+	slog.WarnContext(ctx, "records are put to dead letter", "records", len(failed), "reason", err)
+	return nil
+}
+
+// breaker returns the circuit breaker of the stream. The caller must lock s.mu.
+func (s *LogSender) breaker(stream string) *circuitBreaker {
+	cb, ok := s.breakers[stream]
+	if !ok {
+		cb = newCircuitBreaker(s.circuitBreaker)
+		s.breakers[stream] = cb
 	}
+	return cb
 }
 
-func (s *LogSender) flushToFirehose(ctx context.Context) error {
-	recs := make([]firehoseTypes.Record, 0, len(s.buf))
-	for _, r := range s.buf {
-		recs = append(recs, firehoseTypes.Record{Data: r})
+// limiter returns the rate limiter of the stream. The caller must lock s.mu.
+func (s *LogSender) limiter(stream string) *rateLimiter {
+	l, ok := s.limiters[stream]
+	if !ok {
+		l = newRateLimiter(s.rateLimit)
+		s.limiters[stream] = l
+	}
+	return l
+}
+
+// flushToFirehose sends the payloads to the Firehose stream.
+// When it gives up, it returns the indexes of the payloads failed to send.
+func (s *LogSender) flushToFirehose(ctx context.Context, stream string, policy retry.Policy, limiter *rateLimiter, payloads [][]byte) ([]int, error) {
+	recs := make([]firehoseTypes.Record, 0, len(payloads))
+	pending := make([]int, 0, len(payloads))
+	for i, p := range payloads {
+		recs = append(recs, firehoseTypes.Record{Data: p})
+		pending = append(pending, i)
 	}
 	slog.DebugContext(ctx, "sending to firehose", "records", len(recs))
 
-	err := retryPolicy.Do(ctx, func() error {
-		_, err := s.firehose.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
-			DeliveryStreamName: &s.streamName,
+	start := time.Now()
+	total := len(recs)
+	var attempts int
+	err := policy.Do(ctx, func() error {
+		if attempts++; attempts > 1 {
+			metrics.Retries.Add(1)
+		}
+		var size int
+		for _, r := range recs {
+			size += len(r.Data)
+		}
+		if err := limiter.wait(ctx, len(recs), size); err != nil {
+			return retry.MarkPermanent(err)
+		}
+		out, err := s.firehose.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+			DeliveryStreamName: &stream,
 			Records:            recs,
 		})
-		return err
+		if err != nil {
+			return err
+		}
+		if n := aws.ToInt32(out.FailedPutCount); n > 0 {
+			// retry only the failed records
+			var reason string
+			failed := make([]firehoseTypes.Record, 0, n)
+			failedIdx := make([]int, 0, n)
+			for i, res := range out.RequestResponses {
+				if res.ErrorCode != nil {
+					failed = append(failed, recs[i])
+					failedIdx = append(failedIdx, pending[i])
+					reason = aws.ToString(res.ErrorCode) + ": " + aws.ToString(res.ErrorMessage)
+				}
+			}
+			recs, pending = failed, failedIdx
+			return fmt.Errorf("%d records failed: %s", n, reason)
+		}
+		return nil
 	})
+	metrics.observeFlush(total, time.Since(start))
 	if err != nil {
-		return fmt.Errorf("failed to send to firehose: %w", err)
-	} else {
-		slog.InfoContext(ctx, "sent to firehose", "records", len(recs))
+		return pending, fmt.Errorf("failed to send to firehose: %w", err)
 	}
-	s.resetBuffer()
-	return nil
+	slog.InfoContext(ctx, "sent to firehose", "records", total)
+	return nil, nil
 }
 
-func (s *LogSender) flushToKinesis(ctx context.Context) error {
-	recs := make([]kinesisTypes.PutRecordsRequestEntry, 0, len(s.buf))
-	for _, r := range s.buf {
-		recs = append(recs, kinesisTypes.PutRecordsRequestEntry{Data: r})
+// flushToKinesis sends the payloads to the Kinesis Data Stream.
+// When it gives up, it returns the indexes of the payloads failed to send.
+func (s *LogSender) flushToKinesis(ctx context.Context, stream string, policy retry.Policy, limiter *rateLimiter, payloads [][]byte) ([]int, error) {
+	recs := make([]kinesisTypes.PutRecordsRequestEntry, 0, len(payloads))
+	pending := make([]int, 0, len(payloads))
+	for i, p := range payloads {
+		// the records of a sandbox go to the same shard, so they are kept in order
+		recs = append(recs, kinesisTypes.PutRecordsRequestEntry{Data: p, PartitionKey: aws.String(sandboxID())})
+		pending = append(pending, i)
 	}
 	slog.DebugContext(ctx, "sending to kinesis", "records", len(recs))
 
-	err := retryPolicy.Do(ctx, func() error {
-		_, err := s.kinesis.PutRecords(ctx, &kinesis.PutRecordsInput{
-			Records:    recs,
-			StreamName: &s.streamName,
+	start := time.Now()
+	total := len(recs)
+	var attempts int
+	err := policy.Do(ctx, func() error {
+		if attempts++; attempts > 1 {
+			metrics.Retries.Add(1)
+		}
+		var size int
+		for _, r := range recs {
+			size += len(r.Data)
+		}
+		if err := limiter.wait(ctx, len(recs), size); err != nil {
+			return retry.MarkPermanent(err)
+		}
+		in := &kinesis.PutRecordsInput{Records: recs}
+		if s.streamARN != "" {
+			// StreamARN allows to put to a stream in another account by the resource policy
+			in.StreamARN = &s.streamARN
+		} else {
+			in.StreamName = &stream
+		}
+		out, err := s.kinesis.PutRecords(ctx, in)
+		if err != nil {
+			return err
+		}
+		if n := aws.ToInt32(out.FailedRecordCount); n > 0 {
+			// retry only the failed records
+			var reason string
+			failed := make([]kinesisTypes.PutRecordsRequestEntry, 0, n)
+			failedIdx := make([]int, 0, n)
+			for i, res := range out.Records {
+				if res.ErrorCode != nil {
+					failed = append(failed, recs[i])
+					failedIdx = append(failedIdx, pending[i])
+					reason = aws.ToString(res.ErrorCode) + ": " + aws.ToString(res.ErrorMessage)
+				}
+			}
+			recs, pending = failed, failedIdx
+			return fmt.Errorf("%d records failed: %s", n, reason)
+		}
+		return nil
+	})
+	metrics.observeFlush(total, time.Since(start))
+	if err != nil {
+		return pending, fmt.Errorf("failed to send to kinesis: %w", err)
+	}
+	slog.InfoContext(ctx, "sent to kinesis", "records", total)
+	return nil, nil
+}
+
+// flushToKinesisOrdered puts the payloads one by one with SequenceNumberForOrdering,
+// so the sequence numbers of the records are strictly increasing in the shard.
+// When it gives up, it returns the indexes of the payload failed and the rest.
+func (s *LogSender) flushToKinesisOrdered(ctx context.Context, stream string, policy retry.Policy, limiter *rateLimiter, payloads [][]byte) ([]int, error) {
+	slog.DebugContext(ctx, "sending to kinesis in order", "records", len(payloads))
+	start := time.Now()
+	defer func() {
+		metrics.observeFlush(len(payloads), time.Since(start))
+	}()
+	for i, p := range payloads {
+		in := &kinesis.PutRecordInput{
+			Data:         p,
+			PartitionKey: aws.String(sandboxID()),
+		}
+		if s.streamARN != "" {
+			in.StreamARN = &s.streamARN
+		} else {
+			in.StreamName = &stream
+		}
+		s.mu.Lock()
+		if seq := s.sequenceNumbers[stream]; seq != "" {
+			in.SequenceNumberForOrdering = aws.String(seq)
+		}
+		s.mu.Unlock()
+		var attempts int
+		err := policy.Do(ctx, func() error {
+			if attempts++; attempts > 1 {
+				metrics.Retries.Add(1)
+			}
+			if err := limiter.wait(ctx, 1, len(p)); err != nil {
+				return retry.MarkPermanent(err)
+			}
+			out, err := s.kinesis.PutRecord(ctx, in)
+			if err != nil {
+				return err
+			}
+			s.mu.Lock()
+			s.sequenceNumbers[stream] = aws.ToString(out.SequenceNumber)
+			s.mu.Unlock()
+			return nil
 		})
-		return err
+		if err != nil {
+			rest := make([]int, 0, len(payloads)-i)
+			for j := i; j < len(payloads); j++ {
+				rest = append(rest, j)
+			}
+			return rest, fmt.Errorf("failed to send to kinesis: %w", err)
+		}
+	}
+	slog.InfoContext(ctx, "sent to kinesis in order", "records", len(payloads))
+	return nil, nil
+}
+
+// Check checks the stream exists and is active.
+// For a stream name template, only the fallback stream is checked.
+func (s *LogSender) Check(ctx context.Context) error {
+	stream := s.streamName
+	if s.streamTemplate != nil {
+		if s.fallbackStream == "" {
+			slog.InfoContext(ctx, "skipping the check of the stream name template", "output", s.name)
+			return nil
+		}
+		stream = s.fallbackStream
+	}
+	if s.kinesis != nil {
+		in := &kinesis.DescribeStreamSummaryInput{}
+		if s.streamARN != "" && s.streamTemplate == nil {
+			in.StreamARN = &s.streamARN
+		} else {
+			in.StreamName = &stream
+		}
+		out, err := s.kinesis.DescribeStreamSummary(ctx, in)
+		if err != nil {
+			return fmt.Errorf("failed to describe kinesis stream %s: %w", stream, err)
+		}
+		if out.StreamDescriptionSummary == nil {
+			return fmt.Errorf("kinesis stream %s is not described", stream)
+		}
+		switch st := out.StreamDescriptionSummary.StreamStatus; st {
+		case kinesisTypes.StreamStatusActive, kinesisTypes.StreamStatusUpdating:
+			slog.InfoContext(ctx, "kinesis stream is available", "output", s.name, "stream", stream, "status", st)
+			return nil
+		default:
+			return fmt.Errorf("kinesis stream %s is %s", stream, st)
+		}
+	}
+	out, err := s.firehose.DescribeDeliveryStream(ctx, &firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: &stream,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to send to kinesis: %w", err)
-	} else {
-		slog.InfoContext(ctx, "sent to kinesis", "records", len(recs))
+		return fmt.Errorf("failed to describe firehose stream %s: %w", stream, err)
+	}
+	if out.DeliveryStreamDescription == nil {
+		return fmt.Errorf("firehose stream %s is not described", stream)
+	}
+	if st := out.DeliveryStreamDescription.DeliveryStreamStatus; st != firehoseTypes.DeliveryStreamStatusActive {
+		return fmt.Errorf("firehose stream %s is %s", stream, st)
 	}
-	s.resetBuffer()
+	slog.InfoContext(ctx, "firehose stream is available", "output", s.name, "stream", stream)
 	return nil
 }
 
-func (s *LogSender) resetBuffer() {
-	s.buf = s.buf[:0]
-	s.bufSize = 0
+func (s *LogSender) Status() SinkStatus {
+	s.mu.Lock()
+	st := SinkStatus{
+		Name:        s.name,
+		StreamName:  s.streamName,
+		Type:        "firehose",
+		LastFlushAt: s.lastFlushAt,
+	}
+	if s.kinesis != nil {
+		st.Type = "kinesis"
+	}
+	if s.lastError != nil {
+		st.LastError = s.lastError.Error()
+	}
+	for stream, cb := range s.breakers {
+		if cb.state == circuitOpen {
+			st.OpenCircuits = append(st.OpenCircuits, stream)
+		}
+	}
+	s.mu.Unlock()
+	slices.Sort(st.OpenCircuits)
+
+	for stream, b := range s.streams() {
+		st.BufferRecords += int(b.len.Load())
+		st.BufferBytes += int(b.bytes.Load())
+		st.Streams = append(st.Streams, stream)
+	}
+	slices.Sort(st.Streams)
+	return st
+}
+
+// Len returns the number of records in the buffers.
+func (s *LogSender) Len() int {
+	var n int
+	for _, b := range s.streams() {
+		n += int(b.len.Load())
+	}
+	return n
+}
+
+// resolveStream returns the stream name for the record. The caller must lock s.mu.
+// The stream name template is evaluated with the fields of the JSON record.
+// When the template fails, the result is not a valid stream name,
+// or the number of the streams exceeds maxStreams, the fallback stream is used.
+func (s *LogSender) resolveStream(ctx context.Context, msg []byte) string {
+	if s.streamTemplate == nil {
+		return s.streamName
+	}
+	ctx = slogcontext.WithValue(ctx, "component", "sender")
+	var fields map[string]any
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		slog.DebugContext(ctx, "record is not a JSON object, using fallback stream", "error", err)
+		return s.fallbackStream
+	}
+	buf := new(strings.Builder)
+	if err := s.streamTemplate.Execute(buf, fields); err != nil {
+		slog.DebugContext(ctx, "failed to render stream name, using fallback stream", "error", err)
+		return s.fallbackStream
+	}
+	stream := buf.String()
+	if !streamNamePattern.MatchString(stream) {
+		slog.DebugContext(ctx, "invalid stream name, using fallback stream", "stream", stream)
+		return s.fallbackStream
+	}
+	if _, ok := s.batches[stream]; !ok && s.resolvedStreams() >= s.maxStreams {
+		slog.WarnContext(ctx, "too many streams, using fallback stream", "stream", stream, "max_streams", s.maxStreams)
+		return s.fallbackStream
+	}
+	return stream
+}
+
+// resolvedStreams returns the number of the streams in use resolved by the template.
+// The fallback stream is not counted. The caller must lock s.mu.
+func (s *LogSender) resolvedStreams() int {
+	n := len(s.batches)
+	if _, ok := s.batches[s.fallbackStream]; ok {
+		n--
+	}
+	return n
+}
+
+// batch is a buffer of the records for a stream.
+// The data of the records are copied into the arena, which is reused after the batch is flushed.
+// mu serializes the records and the flushes of the stream.
+type batch struct {
+	mu      sync.Mutex
+	records []Record
+	size    int
+	arena   []byte
+
+	// len and bytes are the status readable without waiting for a flush.
+	len, bytes atomic.Int64
+
+	// removed is set when the batch is removed from LogSender.batches by forget.
+	removed bool
+}
+
+func (b *batch) publish() {
+	b.len.Store(int64(len(b.records)))
+	b.bytes.Store(int64(b.size))
+}
+
+func (b *batch) add(r Record) {
+	// append never overwrites the data referred by the buffered records,
+	// even if it reallocates the arena
+	start := len(b.arena)
+	b.arena = append(b.arena, r.Data...)
+	r.Data = b.arena[start:len(b.arena):len(b.arena)]
+	b.records = append(b.records, r)
+	b.size += len(r.Data)
+	b.publish()
+}
+
+// keep replaces the buffered records by records, which may refer to the arena.
+func (b *batch) keep(records []Record) {
+	b.records = b.records[:0]
+	b.size = 0
+	b.arena = make([]byte, 0, cap(b.arena))
+	for _, r := range records {
+		b.add(r)
+	}
+	b.publish()
+}
+
+func (b *batch) reset() {
+	b.records = b.records[:0]
+	b.size = 0
+	b.arena = b.arena[:0]
+	b.publish()
 }
@@ -0,0 +1,250 @@
+package firetap_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/firetap"
+)
+
+func TestStreamNameTemplate(t *testing.T) {
+	ctx := context.Background()
+	s, err := firetap.NewSender(ctx, firetap.OutputConfig{
+		Name:           "tenants",
+		Type:           "firehose",
+		StreamName:     "logs-{{.tenant}}",
+		FallbackStream: "logs-default",
+		MaxStreams:     3,
+		Batch:          firetap.BatchConfig{MaxRecords: 500, MaxBytes: 1024 * 512},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []string{
+		`{"tenant":"a","message":"foo"}`,
+		`{"tenant":"b","message":"foo"}`,
+		`{"tenant":"a","message":"bar"}`,
+		`{"message":"no tenant"}`,
+		`text record`,
+		`{"tenant":"in/valid"}`,
+		`{"tenant":"c"}`, // the fallback stream is not counted
+		`{"tenant":"d"}`, // exceeds max_streams
+	} {
+		if err := s.Send(ctx, firetap.Record{Data: []byte(r + "\n")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := s.Status()
+	if !slices.Equal(st.Streams, []string{"logs-a", "logs-b", "logs-c", "logs-default"}) {
+		t.Errorf("unexpected streams: %v", st.Streams)
+	}
+	if st.BufferRecords != 8 {
+		t.Errorf("buffer records = %d, want 8", st.BufferRecords)
+	}
+}
+
+func TestStreamNameTemplateWithoutFallback(t *testing.T) {
+	ctx := context.Background()
+	s, err := firetap.NewSender(ctx, firetap.OutputConfig{
+		Type:       "kinesis",
+		StreamName: "logs-{{.level | lower}}",
+		MaxStreams: 10,
+		Batch:      firetap.BatchConfig{MaxRecords: 500, MaxBytes: 1024 * 512},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(ctx, firetap.Record{Data: []byte(`{"level":"ERROR"}` + "\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(ctx, firetap.Record{Data: []byte(`{"message":"no level"}` + "\n")}); err == nil {
+		t.Error("unmatched record must be an error without the fallback stream")
+	}
+	if st := s.Status(); !slices.Equal(st.Streams, []string{"logs-error"}) {
+		t.Errorf("unexpected streams: %v", st.Streams)
+	}
+}
+
+func TestStreamNameTemplateForgetsIdleStreams(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeFirehose{}
+	s := newFakeFirehoseSender(t, f, firetap.OutputConfig{
+		StreamName:     "logs-{{.tenant}}",
+		FallbackStream: "logs-default",
+		MaxStreams:     2,
+	})
+	send := func(tenants ...string) {
+		t.Helper()
+		for _, tenant := range tenants {
+			if err := s.Send(ctx, firetap.Record{Data: []byte(`{"tenant":"` + tenant + `"}` + "\n")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	flush := func() {
+		t.Helper()
+		if err := s.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("a", "b", "c")
+	if st := s.Status(); !slices.Equal(st.Streams, []string{"logs-a", "logs-b", "logs-default"}) {
+		t.Fatalf("unexpected streams: %v", st.Streams)
+	}
+	flush()
+	send("b")
+	// "logs-a" and "logs-default" have been idle since the last flush
+	flush()
+	if st := s.Status(); !slices.Equal(st.Streams, []string{"logs-b"}) {
+		t.Fatalf("idle streams must be removed: %v", st.Streams)
+	}
+	send("c")
+	if st := s.Status(); !slices.Equal(st.Streams, []string{"logs-b", "logs-c"}) {
+		t.Errorf("a new stream must be resolved after the idle streams are removed: %v", st.Streams)
+	}
+}
+
+func TestStreamNameTemplateConcurrentForget(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeFirehose{}
+	s := newFakeFirehoseSender(t, f, firetap.OutputConfig{
+		StreamName: "logs-{{.tenant}}",
+		MaxStreams: 10,
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if err := s.Send(ctx, firetap.Record{Data: []byte(fmt.Sprintf(`{"tenant":"t%d"}`+"\n", j%5))}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := s.Flush(ctx); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("records must not be left in the removed batches: %d", n)
+	}
+}
+
+func TestCloudWatchLogsEnvelope(t *testing.T) {
+	ts := time.Date(2024, 6, 15, 0, 0, 0, 123_000_000, time.UTC)
+	records := []firetap.Record{
+		{Time: ts, Data: []byte("foo\n")},
+		{Time: ts.Add(time.Millisecond), Data: []byte(`{"bar":1}` + "\n")},
+	}
+	payloads, err := firetap.EncodeCloudWatchLogs(records, &firetap.CloudWatchLogsConfig{
+		Owner:     "123456789012",
+		LogGroup:  "/aws/lambda/test",
+		LogStream: "2024/06/15/[$LATEST]abc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 1 {
+		t.Fatalf("payloads = %d, want 1", len(payloads))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(payloads[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env firetap.CloudWatchLogsEnvelope
+	if err := json.NewDecoder(zr).Decode(&env); err != nil {
+		t.Fatal(err)
+	}
+	if env.MessageType != "DATA_MESSAGE" || env.Owner != "123456789012" || env.LogGroup != "/aws/lambda/test" || env.LogStream != "2024/06/15/[$LATEST]abc" {
+		t.Errorf("unexpected envelope: %#v", env)
+	}
+	if len(env.LogEvents) != 2 {
+		t.Fatalf("unexpected log events: %#v", env.LogEvents)
+	}
+	for i, ev := range env.LogEvents {
+		if ev.Timestamp != records[i].Time.UnixMilli() {
+			t.Errorf("timestamp = %d, want %d", ev.Timestamp, records[i].Time.UnixMilli())
+		}
+		if ev.Message != strings.TrimSuffix(string(records[i].Data), "\n") {
+			t.Errorf("message = %s", ev.Message)
+		}
+	}
+	if env.LogEvents[0].ID == env.LogEvents[1].ID {
+		t.Error("event IDs must be unique")
+	}
+}
+
+func TestKinesisOrdered(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "dummy")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "dummy")
+	t.Setenv("AWS_REGION", "us-east-1")
+	var mu sync.Mutex
+	var inputs []map[string]string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var in map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			t.Error(err)
+		}
+		inputs = append(inputs, in)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprintf(w, `{"SequenceNumber":"%d","ShardId":"shardId-000000000000"}`, len(inputs))
+	}))
+	defer s.Close()
+
+	ctx := context.Background()
+	sender, err := firetap.NewSender(ctx, firetap.OutputConfig{
+		Type:       "kinesis",
+		StreamName: "test",
+		Endpoint:   s.URL,
+		Ordered:    true,
+		Batch:      firetap.BatchConfig{MaxRecords: 500, MaxBytes: 1024 * 512},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []string{"foo\n", "bar\n", "baz\n"} {
+		if err := sender.Send(ctx, firetap.Record{Data: []byte(r)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sender.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) != 3 {
+		t.Fatalf("PutRecord must be called for each record: %d", len(inputs))
+	}
+	for i, in := range inputs {
+		if in["PartitionKey"] == "" || in["PartitionKey"] != inputs[0]["PartitionKey"] {
+			t.Errorf("unexpected partition key: %v", in)
+		}
+		want := ""
+		if i > 0 {
+			want = fmt.Sprint(i)
+		}
+		if in["SequenceNumberForOrdering"] != want {
+			t.Errorf("SequenceNumberForOrdering of #%d = %q, want %q", i, in["SequenceNumberForOrdering"], want)
+		}
+	}
+}
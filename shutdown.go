@@ -0,0 +1,90 @@
+package firetap
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	slogcontext "github.com/PumpkinSeed/slog-context"
+)
+
+const (
+	// shutdownMargin is reserved before the deadline to give up cleanly.
+	shutdownMargin = 100 * time.Millisecond
+	// maxDrainDuration is the max duration to wait for the final telemetry delivery.
+	// The platform delivers the buffered telemetry within the buffering timeout (TimeoutMs).
+	maxDrainDuration = 1500 * time.Millisecond
+)
+
+// shutdownPlan is a time budget of the shutdown sequence derived from the deadline of the SHUTDOWN event.
+type shutdownPlan struct {
+	drainUntil    time.Time
+	receiverUntil time.Time
+	flushUntil    time.Time
+}
+
+func newShutdownPlan(now, deadline time.Time) shutdownPlan {
+	end := deadline.Add(-shutdownMargin)
+	if end.Before(now) {
+		end = now
+	}
+	budget := end.Sub(now)
+	return shutdownPlan{
+		drainUntil:    now.Add(min(budget/2, maxDrainDuration)),
+		receiverUntil: now.Add(budget * 3 / 4),
+		flushUntil:    end,
+	}
+}
+
+// gracefulShutdown runs the shutdown sequence within the deadline of the SHUTDOWN event.
+//
+//  1. drains the final telemetry delivery from the platform
+//  2. stops the receiver, emits the final metrics and flushes the sender (and the invocation metrics and the spans)
+//  3. gives up and reports the records lost
+func gracefulShutdown(ctx context.Context, ev *ExtensionEvent, rcv *Receiver, sender *Pipeline, emitter *MetricsEmitter) {
+	ctx = slogcontext.WithValue(ctx, "component", "shutdown")
+	now := time.Now()
+	plan := newShutdownPlan(now, ev.Deadline())
+	slog.InfoContext(ctx, "shutting down",
+		"reason", ev.ShutdownReason,
+		"deadline", ev.Deadline(),
+		"budget", plan.flushUntil.Sub(now),
+	)
+
+	// 1. drain
+	select {
+	case <-time.After(time.Until(plan.drainUntil)):
+	case <-ctx.Done():
+	}
+
+	// 2. stop the receiver, waiting for the in-flight telemetry, and flush
+	rctx, cancel := context.WithDeadline(context.Background(), plan.receiverUntil)
+	defer cancel()
+	if err := rcv.Shutdown(rctx); err != nil {
+		slog.WarnContext(ctx, "failed to shut down receiver in time", "error", err)
+	}
+	fctx, cancel := context.WithDeadline(context.Background(), plan.flushUntil)
+	defer cancel()
+	emitter.Close(fctx) // flushed with the records
+	if err := sender.Flush(fctx); err != nil {
+		slog.WarnContext(ctx, "failed to flush", "error", err)
+	}
+	if m := rcv.InvocationMetrics; m != nil {
+		if err := m.Close(fctx); err != nil {
+			slog.WarnContext(ctx, "failed to flush invocation metrics", "error", err)
+		}
+	}
+	if e := rcv.Spans; e != nil {
+		if err := e.Close(fctx); err != nil {
+			slog.WarnContext(ctx, "failed to export spans", "error", err)
+		}
+	}
+
+	// 3. give up
+	if lost := sender.Len(); lost > 0 {
+		metrics.Dropped.Add(int64(lost))
+		slog.ErrorContext(ctx, "records are lost at shutdown", "reason", ev.ShutdownReason, "lost", lost)
+	} else {
+		slog.InfoContext(ctx, "shutdown completed", "reason", ev.ShutdownReason, "elapsed", time.Since(now))
+	}
+}
@@ -0,0 +1,76 @@
+package firetap_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/firetap"
+)
+
+func TestShutdownPlan(t *testing.T) {
+	now := time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name                   string
+		deadline               time.Time
+		drain, receiver, flush time.Duration
+	}{
+		{
+			name:     "normal budget caps the drain",
+			deadline: now.Add(2 * time.Second),
+			drain:    950 * time.Millisecond,
+			receiver: 1425 * time.Millisecond,
+			flush:    1900 * time.Millisecond,
+		},
+		{
+			name:     "long budget",
+			deadline: now.Add(10 * time.Second),
+			drain:    1500 * time.Millisecond,
+			receiver: 7425 * time.Millisecond,
+			flush:    9900 * time.Millisecond,
+		},
+		{
+			name:     "budget under 1.5s",
+			deadline: now.Add(time.Second),
+			drain:    450 * time.Millisecond,
+			receiver: 675 * time.Millisecond,
+			flush:    900 * time.Millisecond,
+		},
+		{
+			name:     "deadline in the past",
+			deadline: now.Add(-time.Second),
+		},
+		{
+			name:     "deadline within the margin",
+			deadline: now.Add(50 * time.Millisecond),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			drain, receiver, flush := firetap.NewShutdownPlan(now, tc.deadline)
+			if got := drain.Sub(now); got != tc.drain {
+				t.Errorf("drain = %s, want %s", got, tc.drain)
+			}
+			if got := receiver.Sub(now); got != tc.receiver {
+				t.Errorf("receiver = %s, want %s", got, tc.receiver)
+			}
+			if got := flush.Sub(now); got != tc.flush {
+				t.Errorf("flush = %s, want %s", got, tc.flush)
+			}
+		})
+	}
+}
+
+func TestShutdownEvent(t *testing.T) {
+	// https://docs.aws.amazon.com/lambda/latest/dg/runtimes-extensions-api.html#extensions-api-shutdown
+	payload := `{"eventType":"SHUTDOWN","shutdownReason":"spindown","deadlineMs":1581512138111}`
+	var ev firetap.ExtensionEvent
+	if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.EventType != "SHUTDOWN" || ev.ShutdownReason != "spindown" {
+		t.Errorf("unexpected event: %#v", ev)
+	}
+	if want := time.Date(2020, 2, 12, 12, 55, 38, 111_000_000, time.UTC); !ev.Deadline().Equal(want) {
+		t.Errorf("deadline = %s, want %s", ev.Deadline().UTC(), want)
+	}
+}
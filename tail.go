@@ -0,0 +1,402 @@
+package firetap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	slogcontext "github.com/PumpkinSeed/slog-context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesisTypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/shogo82148/go-retry"
+)
+
+// tailReadInterval is the min interval of GetRecords of a shard,
+// within the limit of 5 reads per second per shard.
+const tailReadInterval = 200 * time.Millisecond
+
+// tailRetryPolicy is the backoff of GetRecords throttled or with an expired iterator.
+var tailRetryPolicy = retry.Policy{
+	MinDelay: time.Second,
+	MaxDelay: 10 * time.Second,
+}
+
+// TailOption represents the options of the tail command.
+type TailOption struct {
+	Stream       string        `arg:"" optional:"" help:"Kinesis Data Stream name or ARN. The first kinesis output of the configuration is used when omitted"`
+	From         string        `help:"Position to start reading (latest, RFC3339 timestamp or duration ago like 10m)" default:"latest"`
+	RequestID    string        `help:"Print only the lines of the request ID"`
+	Level        string        `help:"Print only the lines of the level (case insensitive)"`
+	Endpoint     string        `help:"Endpoint URL of Kinesis Data Streams"`
+	Region       string        `help:"AWS region"`
+	PollInterval time.Duration `help:"Interval of GetRecords when no records" default:"1s"`
+}
+
+// Tail prints the lines in the Kinesis Data Stream.
+func Tail(ctx context.Context, opt *Option) error {
+	ctx = slogcontext.WithValue(ctx, "component", "tail")
+	out, err := tailOutput(opt)
+	if err != nil {
+		return err
+	}
+	dest, err := parseDestination(out.StreamName)
+	if err != nil {
+		return err
+	}
+	awsCfg, err := loadAWSConfig(ctx, out, dest)
+	if err != nil {
+		return err
+	}
+	client := kinesis.NewFromConfig(awsCfg, func(o *kinesis.Options) {
+		if out.Endpoint != "" {
+			o.BaseEndpoint = aws.String(out.Endpoint)
+		}
+	})
+	from, err := parseTailFrom(opt.Tail.From, time.Now())
+	if err != nil {
+		return err
+	}
+	t := &Tailer{
+		client:       client,
+		stream:       dest.name,
+		streamARN:    dest.arn,
+		from:         from,
+		filter:       newTailFilter(opt.Tail.RequestID, opt.Tail.Level),
+		pollInterval: opt.Tail.PollInterval,
+		readInterval: tailReadInterval,
+		retryPolicy:  tailRetryPolicy,
+		w:            os.Stdout,
+	}
+	return t.Run(ctx)
+}
+
+func tailOutput(opt *Option) (OutputConfig, error) {
+	out := OutputConfig{Type: outputTypeKinesis, StreamName: opt.Tail.Stream}
+	if out.StreamName == "" {
+		cfg, err := LoadConfig(opt)
+		if err != nil {
+			return out, err
+		}
+		found := false
+		for _, o := range cfg.Outputs {
+			if o.Type == outputTypeKinesis && !isStreamTemplate(o.StreamName) {
+				out, found = o, true
+				break
+			}
+		}
+		if !found {
+			return out, fmt.Errorf("no kinesis output in the configuration, specify the stream")
+		}
+	}
+	if opt.Tail.Endpoint != "" {
+		out.Endpoint = opt.Tail.Endpoint
+	}
+	if opt.Tail.Region != "" {
+		out.Region = opt.Tail.Region
+	}
+	return out, nil
+}
+
+// parseTailFrom parses the start position. The zero time means LATEST.
+func parseTailFrom(s string, now time.Time) (time.Time, error) {
+	if s == "" || s == "latest" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --from: %s", s)
+}
+
+// Tailer reads all shards of a Kinesis Data Stream and writes the lines.
+type Tailer struct {
+	client       *kinesis.Client
+	stream       string
+	streamARN    string
+	from         time.Time
+	filter       *tailFilter
+	pollInterval time.Duration
+	readInterval time.Duration
+	retryPolicy  retry.Policy
+	w            io.Writer
+
+	mu      sync.Mutex
+	started map[string]bool
+	wg      sync.WaitGroup
+}
+
+// Run reads the shards until ctx is done or all shards are closed.
+func (t *Tailer) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	t.started = make(map[string]bool)
+	var next *string
+	for {
+		in := &kinesis.ListShardsInput{NextToken: next}
+		if next == nil {
+			t.setStream(&in.StreamName, &in.StreamARN)
+		}
+		out, err := t.client.ListShards(ctx, in)
+		if err != nil {
+			// stop the shards of the previous pages
+			cancel()
+			t.wg.Wait()
+			return fmt.Errorf("failed to list shards: %w", err)
+		}
+		for _, shard := range out.Shards {
+			if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil && t.from.IsZero() {
+				continue // closed shards have no new records
+			}
+			t.startShard(ctx, aws.ToString(shard.ShardId), t.from.IsZero())
+		}
+		if next = out.NextToken; next == nil {
+			break
+		}
+	}
+	t.wg.Wait()
+	return nil
+}
+
+func (t *Tailer) setStream(name, arn **string) {
+	if t.streamARN != "" {
+		*arn = aws.String(t.streamARN)
+	} else {
+		*name = aws.String(t.stream)
+	}
+}
+
+func (t *Tailer) startShard(ctx context.Context, shardID string, latest bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.started[shardID] {
+		return
+	}
+	t.started[shardID] = true
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ctx := slogcontext.WithValue(ctx, "shard", shardID)
+		if err := t.readShard(ctx, shardID, latest); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "failed to read shard", "error", err)
+		}
+	}()
+}
+
+func (t *Tailer) readShard(ctx context.Context, shardID string, latest bool) error {
+	iterator, err := t.shardIterator(ctx, shardID, latest, "")
+	if err != nil {
+		return err
+	}
+	var lastSeq string
+	next := time.Now()
+	for iterator != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(next)):
+		}
+		out, err := t.getRecords(ctx, shardID, latest, &iterator, lastSeq)
+		if err != nil {
+			return err
+		}
+		for _, rec := range out.Records {
+			if err := t.writeRecord(rec.Data); err != nil {
+				slog.WarnContext(ctx, "failed to read record", "sequence_number", aws.ToString(rec.SequenceNumber), "error", err)
+			}
+			lastSeq = aws.ToString(rec.SequenceNumber)
+		}
+		for _, child := range out.ChildShards {
+			t.startShard(ctx, aws.ToString(child.ShardId), false)
+		}
+		iterator = out.NextShardIterator
+		// paced from the end of the call, as the call may have been retried
+		if len(out.Records) == 0 {
+			next = time.Now().Add(max(t.readInterval, t.pollInterval))
+		} else {
+			next = time.Now().Add(t.readInterval)
+		}
+	}
+	slog.DebugContext(ctx, "shard is closed")
+	return nil
+}
+
+// shardIterator returns the iterator of the shard after the sequence number,
+// or at the start position without it.
+func (t *Tailer) shardIterator(ctx context.Context, shardID string, latest bool, after string) (*string, error) {
+	in := &kinesis.GetShardIteratorInput{ShardId: aws.String(shardID)}
+	t.setStream(&in.StreamName, &in.StreamARN)
+	switch {
+	case after != "":
+		in.ShardIteratorType = kinesisTypes.ShardIteratorTypeAfterSequenceNumber
+		in.StartingSequenceNumber = aws.String(after)
+	case latest:
+		in.ShardIteratorType = kinesisTypes.ShardIteratorTypeLatest
+	case t.from.IsZero():
+		// the child shards of a closed shard are read from the beginning
+		in.ShardIteratorType = kinesisTypes.ShardIteratorTypeTrimHorizon
+	default:
+		in.ShardIteratorType = kinesisTypes.ShardIteratorTypeAtTimestamp
+		in.Timestamp = aws.Time(t.from)
+	}
+	out, err := t.client.GetShardIterator(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shard iterator: %w", err)
+	}
+	return out.ShardIterator, nil
+}
+
+// getRecords calls GetRecords with the backoff on the throttling.
+// An expired iterator is replaced by the iterator after the last sequence number.
+func (t *Tailer) getRecords(ctx context.Context, shardID string, latest bool, iterator **string, lastSeq string) (*kinesis.GetRecordsOutput, error) {
+	var out *kinesis.GetRecordsOutput
+	err := t.retryPolicy.Do(ctx, func() error {
+		in := &kinesis.GetRecordsInput{ShardIterator: *iterator}
+		if t.streamARN != "" {
+			in.StreamARN = aws.String(t.streamARN)
+		}
+		var err error
+		out, err = t.client.GetRecords(ctx, in)
+		var throttled *kinesisTypes.ProvisionedThroughputExceededException
+		var expired *kinesisTypes.ExpiredIteratorException
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &throttled):
+			slog.DebugContext(ctx, "GetRecords is throttled, retrying", "error", err)
+			return err
+		case errors.As(err, &expired):
+			slog.DebugContext(ctx, "shard iterator is expired, renewing", "after", lastSeq)
+			it, ierr := t.shardIterator(ctx, shardID, latest, lastSeq)
+			if ierr != nil {
+				return retry.MarkPermanent(ierr)
+			}
+			*iterator = it
+			return err
+		default:
+			return retry.MarkPermanent(err)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get records: %w", err)
+	}
+	return out, nil
+}
+
+func (t *Tailer) writeRecord(data []byte) error {
+	records, err := deaggregate(data)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, r := range records {
+		lines, err := unwrapRecord(r)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if t.filter.match(line) {
+				buf.WriteString(line)
+				buf.WriteByte('\n')
+			}
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err = t.w.Write(buf.Bytes())
+	return err
+}
+
+// unwrapRecord decompresses the record and unwraps the CloudWatch Logs envelope.
+// It returns the lines in the record.
+func unwrapRecord(data []byte) ([]string, error) {
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
+	}
+	if bytes.HasPrefix(data, []byte(`{"messageType":`)) {
+		var env CloudWatchLogsEnvelope
+		if err := json.Unmarshal(data, &env); err == nil {
+			if env.MessageType != "DATA_MESSAGE" {
+				return nil, nil
+			}
+			lines := make([]string, 0, len(env.LogEvents))
+			for _, ev := range env.LogEvents {
+				lines = append(lines, strings.TrimRight(ev.Message, "\n"))
+			}
+			return lines, nil
+		}
+	}
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n"), nil
+}
+
+// tailFilter matches the lines by the request ID and the level.
+// The fields of a JSON line ("requestId", "level" and so on) are compared,
+// and a text line is matched by the words.
+type tailFilter struct {
+	requestID string
+	level     string
+	levelText *regexp.Regexp
+}
+
+func newTailFilter(requestID, level string) *tailFilter {
+	f := &tailFilter{requestID: requestID, level: level}
+	if level != "" {
+		f.levelText = regexp.MustCompile(`(?i)(^|[\s\[])` + regexp.QuoteMeta(level) + `($|[\s\]:])`)
+	}
+	return f
+}
+
+func (f *tailFilter) match(line string) bool {
+	if f.requestID == "" && f.level == "" {
+		return true
+	}
+	var fields map[string]any
+	if strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &fields) == nil {
+		if f.requestID != "" && !fieldEquals(fields, f.requestID, false, "requestId", "request_id", "RequestId") {
+			return false
+		}
+		if f.level != "" && !fieldEquals(fields, f.level, true, "level", "severity", "levelname") {
+			return false
+		}
+		return true
+	}
+	if f.requestID != "" && !strings.Contains(line, f.requestID) {
+		return false
+	}
+	if f.levelText != nil && !f.levelText.MatchString(line) {
+		return false
+	}
+	return true
+}
+
+func fieldEquals(fields map[string]any, value string, fold bool, keys ...string) bool {
+	for _, k := range keys {
+		v, ok := fields[k].(string)
+		if !ok {
+			continue
+		}
+		if v == value || (fold && strings.EqualFold(v, value)) {
+			return true
+		}
+	}
+	return false
+}
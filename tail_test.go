@@ -0,0 +1,256 @@
+package firetap_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/fujiwara/firetap"
+)
+
+// fakeKinesis is a stand-in of Kinesis Data Streams with the fixed records.
+// shard-0 is closed after its records, and shard-1 is the child of it.
+// An iterator is "<shard>/<index of the next record>".
+type fakeKinesis struct {
+	mu        sync.Mutex
+	shards    map[string][][]byte
+	iterators []string       // requested iterator types
+	faults    map[int]string // error types by the index of GetRecords of shard-0
+	reads     []time.Time    // GetRecords of shard-0
+	gets      int            // GetRecords of all shards
+	listFault string         // error type of ListShards of the second page
+}
+
+func (f *fakeKinesis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var in map[string]any
+	json.NewDecoder(r.Body).Decode(&in)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	var out any
+	switch op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "Kinesis_20131202."); op {
+	case "ListShards":
+		if f.listFault != "" && in["NextToken"] != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": f.listFault, "message": "fault"})
+			return
+		}
+		page := map[string]any{"Shards": []map[string]any{
+			{"ShardId": "shard-0", "HashKeyRange": map[string]string{"StartingHashKey": "0", "EndingHashKey": "1"}, "SequenceNumberRange": map[string]string{"StartingSequenceNumber": "0"}},
+		}}
+		if f.listFault != "" {
+			page["NextToken"] = "page-2"
+		}
+		out = page
+	case "GetShardIterator":
+		typ := in["ShardIteratorType"].(string)
+		f.iterators = append(f.iterators, typ)
+		pos := 0
+		if typ == "AFTER_SEQUENCE_NUMBER" {
+			pos, _ = strconv.Atoi(in["StartingSequenceNumber"].(string))
+			pos++
+		}
+		out = map[string]any{"ShardIterator": in["ShardId"].(string) + "/" + strconv.Itoa(pos)}
+	case "GetRecords":
+		f.gets++
+		shard, p, _ := strings.Cut(in["ShardIterator"].(string), "/")
+		pos, _ := strconv.Atoi(p)
+		if shard == "shard-0" {
+			f.reads = append(f.reads, time.Now())
+			if typ, ok := f.faults[len(f.reads)-1]; ok {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"__type": typ, "message": "fault"})
+				return
+			}
+		}
+		res := map[string]any{"MillisBehindLatest": 0}
+		records := f.shards[shard]
+		if pos < len(records) {
+			var recs []map[string]any
+			for i, d := range records[pos:] {
+				recs = append(recs, map[string]any{"Data": d, "SequenceNumber": strconv.Itoa(pos + i), "PartitionKey": "k"})
+			}
+			res["Records"] = recs
+			res["NextShardIterator"] = shard + "/" + strconv.Itoa(len(records))
+		} else if shard == "shard-0" {
+			// closed
+			res["Records"] = []any{}
+			res["ChildShards"] = []map[string]any{
+				{"ShardId": "shard-1", "ParentShards": []string{"shard-0"}, "HashKeyRange": map[string]string{"StartingHashKey": "0", "EndingHashKey": "1"}},
+			}
+		} else {
+			res["Records"] = []any{}
+			res["NextShardIterator"] = in["ShardIterator"]
+		}
+		out = res
+	default:
+		http.Error(w, "unknown operation "+op, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+// kplAggregate builds a KPL aggregated record.
+func kplAggregate(records ...string) []byte {
+	var body []byte
+	body = append(body, 0x0a, 1, 'k') // partition_key_table
+	for _, r := range records {
+		rec := append([]byte{0x08, 0x00, 0x1a, byte(len(r))}, r...) // partition_key_index, data
+		body = append(body, 0x1a, byte(len(rec)))
+		body = append(body, rec...)
+	}
+	sum := md5.Sum(body)
+	b := append([]byte{0xf3, 0x89, 0x9a, 0xc2}, body...)
+	return append(b, sum[:]...)
+}
+
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func newFakeKinesis() *fakeKinesis {
+	envelope := `{"messageType":"DATA_MESSAGE","owner":"123456789012","logGroup":"g","logStream":"s","subscriptionFilters":[],"logEvents":[` +
+		`{"id":"1","timestamp":1718409600000,"message":"{\"level\":\"ERROR\",\"requestId\":\"req-1\",\"message\":\"boom\"}\n"},` +
+		`{"id":"2","timestamp":1718409600000,"message":"{\"level\":\"info\",\"requestId\":\"req-2\"}\n"}]}`
+	return &fakeKinesis{shards: map[string][][]byte{
+		"shard-0": {
+			[]byte("2024-06-15T00:00:00.000Z\treq-1\tINFO\thello\n"),
+			gzipped(envelope),
+			gzipped(`{"messageType":"CONTROL_MESSAGE","logEvents":[{"id":"","timestamp":0,"message":"CWL CONTROL MESSAGE"}]}`),
+		},
+		"shard-1": {
+			kplAggregate("[WARNING]\t2024-06-15T00:00:00.000Z\treq-2\tcareful\n", `{"level":"warn","requestId":"req-1"}`+"\n"),
+		},
+	}}
+}
+
+func runTail(t *testing.T, f *fakeKinesis, requestID, level string) string {
+	t.Helper()
+	s := httptest.NewServer(f)
+	t.Cleanup(s.Close)
+	client := kinesis.New(kinesis.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(s.URL),
+		Credentials:      credentials.NewStaticCredentialsProvider("dummy", "dummy", ""),
+		RetryMaxAttempts: 1,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	var buf bytes.Buffer
+	tailer := firetap.NewTailer(client, "test", time.Now().Add(-time.Hour), requestID, level, &buf)
+	if err := tailer.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+const tailExpected = "2024-06-15T00:00:00.000Z\treq-1\tINFO\thello\n" +
+	`{"level":"ERROR","requestId":"req-1","message":"boom"}` + "\n" +
+	`{"level":"info","requestId":"req-2"}` + "\n" +
+	"[WARNING]\t2024-06-15T00:00:00.000Z\treq-2\tcareful\n" +
+	`{"level":"warn","requestId":"req-1"}` + "\n"
+
+func TestTail(t *testing.T) {
+	f := newFakeKinesis()
+	if out := runTail(t, f, "", ""); out != tailExpected {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	if strings.Join(f.iterators, ",") != "AT_TIMESTAMP,AT_TIMESTAMP" {
+		t.Errorf("unexpected iterator types: %v", f.iterators)
+	}
+}
+
+func TestTailListShardsError(t *testing.T) {
+	f := newFakeKinesis()
+	f.listFault = "LimitExceededException"
+	s := httptest.NewServer(f)
+	defer s.Close()
+	client := kinesis.New(kinesis.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(s.URL),
+		Credentials:      credentials.NewStaticCredentialsProvider("dummy", "dummy", ""),
+		RetryMaxAttempts: 1,
+	})
+	var buf bytes.Buffer
+	tailer := firetap.NewTailer(client, "test", time.Now().Add(-time.Hour), "", "", &buf)
+	if err := tailer.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "failed to list shards") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the shards of the first page must be stopped
+	f.mu.Lock()
+	gets := f.gets
+	f.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.gets != gets {
+		t.Errorf("shards are still read after Run returns: %d -> %d", gets, f.gets)
+	}
+}
+
+func TestTailRetry(t *testing.T) {
+	f := newFakeKinesis()
+	f.faults = map[int]string{
+		0: "ProvisionedThroughputExceededException",
+		2: "ExpiredIteratorException", // after the records
+	}
+	if out := runTail(t, f, "", ""); out != tailExpected {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	if strings.Join(f.iterators, ",") != "AT_TIMESTAMP,AFTER_SEQUENCE_NUMBER,AT_TIMESTAMP" {
+		t.Errorf("unexpected iterator types: %v", f.iterators)
+	}
+	if len(f.reads) != 4 {
+		t.Fatalf("unexpected reads of shard-0: %d", len(f.reads))
+	}
+	// the records are returned by reads[1], and the next read is paced
+	if d := f.reads[2].Sub(f.reads[1]); d < 5*time.Millisecond {
+		t.Errorf("GetRecords must be paced: %s", d)
+	}
+}
+
+func TestTailFilter(t *testing.T) {
+	for _, tc := range []struct {
+		requestID string
+		level     string
+		want      string
+	}{
+		{
+			requestID: "req-1",
+			want: "2024-06-15T00:00:00.000Z\treq-1\tINFO\thello\n" +
+				`{"level":"ERROR","requestId":"req-1","message":"boom"}` + "\n" +
+				`{"level":"warn","requestId":"req-1"}` + "\n",
+		},
+		{
+			level: "info",
+			want: "2024-06-15T00:00:00.000Z\treq-1\tINFO\thello\n" +
+				`{"level":"info","requestId":"req-2"}` + "\n",
+		},
+		{
+			requestID: "req-2",
+			level:     "WARNING",
+			want:      "[WARNING]\t2024-06-15T00:00:00.000Z\treq-2\tcareful\n",
+		},
+	} {
+		out := runTail(t, newFakeKinesis(), tc.requestID, tc.level)
+		if out != tc.want {
+			t.Errorf("request_id=%s level=%s: unexpected output:\n%s", tc.requestID, tc.level, out)
+		}
+	}
+}
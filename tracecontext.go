@@ -0,0 +1,201 @@
+package firetap
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+const (
+	tracingTypeXRay        = "X-Amzn-Trace-Id"
+	tracingTypeTraceparent = "traceparent"
+
+	// maxTraceContexts is the number of the invocations to keep the trace contexts.
+	// The logs of an invocation may arrive after the next invocation starts.
+	maxTraceContexts = 16
+)
+
+// traceContext is the trace context of an invocation in the W3C (OpenTelemetry) format.
+type traceContext struct {
+	TraceID string // 32 hex digits
+	SpanID  string // 16 hex digits
+	Sampled bool
+}
+
+// platformTracing is the tracing of platform.start and platform.runtimeDone.
+// https://docs.aws.amazon.com/lambda/latest/dg/telemetry-schema-reference.html#TraceContext
+type platformTracing struct {
+	SpanID string `json:"spanId,omitempty"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+}
+
+// traceContext returns the trace context of the tracing.
+// The span ID is the span of the invocation created by Lambda if any,
+// otherwise the parent in the tracing header.
+func (t *platformTracing) traceContext() (traceContext, bool) {
+	tc, ok := parseTracing(t.Type, t.Value)
+	if !ok {
+		return tc, false
+	}
+	if isHexID(t.SpanID, 16) {
+		tc.SpanID = strings.ToLower(t.SpanID)
+	}
+	return tc, true
+}
+
+func parseTracing(typ, value string) (traceContext, bool) {
+	switch typ {
+	case tracingTypeXRay:
+		return parseXRayTraceHeader(value)
+	case tracingTypeTraceparent:
+		return parseTraceparent(value)
+	}
+	return traceContext{}, false
+}
+
+// parseXRayTraceHeader parses the X-Ray trace header like
+// "Root=1-5e1b4151-5ac6c58f2a0c3d4d4c7e1b2f;Parent=53995c3f42cd8ad8;Sampled=1".
+// The trace ID of X-Ray is converted to the W3C format by removing the version and the dashes.
+func parseXRayTraceHeader(v string) (traceContext, bool) {
+	var tc traceContext
+	for _, kv := range strings.Split(v, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		switch k {
+		case "Root":
+			parts := strings.Split(v, "-")
+			if len(parts) != 3 || parts[0] != "1" || len(parts[1]) != 8 || !isHexID(parts[1]+parts[2], 32) {
+				return traceContext{}, false
+			}
+			tc.TraceID = strings.ToLower(parts[1] + parts[2])
+		case "Parent":
+			if isHexID(v, 16) {
+				tc.SpanID = strings.ToLower(v)
+			}
+		case "Sampled":
+			tc.Sampled = v == "1"
+		}
+	}
+	if tc.TraceID == "" {
+		return traceContext{}, false
+	}
+	return tc, true
+}
+
+// parseTraceparent parses the W3C traceparent header like
+// "00-5e1b41515ac6c58f2a0c3d4d4c7e1b2f-53995c3f42cd8ad8-01".
+func parseTraceparent(v string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || !isHexID(parts[1], 32) || !isHexID(parts[2], 16) {
+		return traceContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return traceContext{}, false
+	}
+	return traceContext{
+		TraceID: strings.ToLower(parts[1]),
+		SpanID:  strings.ToLower(parts[2]),
+		Sampled: flags[0]&1 == 1,
+	}, true
+}
+
+// isHexID reports whether s is n hex digits and not all zero (invalid in W3C).
+func isHexID(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	zero := true
+	for _, c := range s {
+		switch {
+		case c == '0':
+		case '1' <= c && c <= '9', 'a' <= c && c <= 'f', 'A' <= c && c <= 'F':
+			zero = false
+		default:
+			return false
+		}
+	}
+	return !zero
+}
+
+// traceContexts tracks the trace contexts of the recent invocations by the request ID.
+type traceContexts struct {
+	mu        sync.Mutex
+	byRequest map[string]traceContext
+	requests  []string // in the order of arrival, to evict the oldest
+	current   string
+}
+
+// set sets the trace context of the invocation. Unless overwrite, the known trace context is kept.
+// An empty span ID does not overwrite the known one.
+func (c *traceContexts) set(requestID string, tc traceContext, overwrite bool) {
+	if requestID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.byRequest == nil {
+		c.byRequest = make(map[string]traceContext, maxTraceContexts)
+	}
+	if prev, ok := c.byRequest[requestID]; ok {
+		if !overwrite {
+			return
+		}
+		if tc.SpanID == "" {
+			tc.SpanID = prev.SpanID
+		}
+	} else {
+		if len(c.requests) == maxTraceContexts {
+			delete(c.byRequest, c.requests[0])
+			c.requests = c.requests[1:]
+		}
+		c.requests = append(c.requests, requestID)
+	}
+	c.byRequest[requestID] = tc
+}
+
+// start marks the invocation as the current one, which the following function logs belong to.
+func (c *traceContexts) start(requestID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = requestID
+}
+
+// get returns the trace context of the invocation, or the current invocation when requestID is empty.
+func (c *traceContexts) get(requestID string) (traceContext, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if requestID == "" {
+		requestID = c.current
+	}
+	tc, ok := c.byRequest[requestID]
+	return tc, ok
+}
+
+// observePlatform tracks the invocations by platform.start and platform.runtimeDone.
+func (c *traceContexts) observePlatform(typ string, record []byte) {
+	var r struct {
+		RequestID string           `json:"requestId"`
+		Tracing   *platformTracing `json:"tracing,omitempty"`
+	}
+	if err := json.Unmarshal(record, &r); err != nil || r.RequestID == "" {
+		return
+	}
+	if r.Tracing != nil {
+		if tc, ok := r.Tracing.traceContext(); ok {
+			c.set(r.RequestID, tc, true)
+		}
+	}
+	if typ == "platform.start" {
+		c.start(r.RequestID)
+	}
+}
+
+// observeInvoke tracks the invocation by the INVOKE event of the Extensions API.
+// The tracing of the platform events takes precedence, because it has the span of the invocation.
+func (c *traceContexts) observeInvoke(ev *ExtensionEvent) {
+	if tc, ok := parseTracing(ev.Tracing.Type, ev.Tracing.Value); ok {
+		c.set(ev.RequestID, tc, false)
+	}
+}
@@ -0,0 +1,111 @@
+package firetap_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/fujiwara/firetap"
+)
+
+func TestParseTracing(t *testing.T) {
+	for _, tc := range []struct {
+		typ, value      string
+		traceID, spanID string
+		sampled, ok     bool
+	}{
+		{
+			typ: "X-Amzn-Trace-Id", value: "Root=1-5e1b4151-5ac6c58f2a0c3d4d4c7e1b2f;Parent=53995c3f42cd8ad8;Sampled=1",
+			traceID: "5e1b41515ac6c58f2a0c3d4d4c7e1b2f", spanID: "53995c3f42cd8ad8", sampled: true, ok: true,
+		},
+		{
+			typ: "X-Amzn-Trace-Id", value: "Root=1-5E1B4151-5AC6C58F2A0C3D4D4C7E1B2F;Sampled=0;Lineage=a87bd80c:0",
+			traceID: "5e1b41515ac6c58f2a0c3d4d4c7e1b2f", ok: true,
+		},
+		{
+			typ: "traceparent", value: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			traceID: "0af7651916cd43dd8448eb211c80319c", spanID: "b7ad6b7169203331", sampled: true, ok: true,
+		},
+		{typ: "X-Amzn-Trace-Id", value: "Root=2-5e1b4151-5ac6c58f2a0c3d4d4c7e1b2f"},
+		{typ: "X-Amzn-Trace-Id", value: "Parent=53995c3f42cd8ad8;Sampled=1"},
+		{typ: "traceparent", value: "00-00000000000000000000000000000000-b7ad6b7169203331-01"},
+		{typ: "traceparent", value: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331"},
+		{typ: "unknown", value: "Root=1-5e1b4151-5ac6c58f2a0c3d4d4c7e1b2f"},
+	} {
+		traceID, spanID, sampled, ok := firetap.ParseTracing(tc.typ, tc.value)
+		if ok != tc.ok || traceID != tc.traceID || spanID != tc.spanID || sampled != tc.sampled {
+			t.Errorf("%s %s: got %s %s %v %v", tc.typ, tc.value, traceID, spanID, sampled, ok)
+		}
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	sender := &testLogSender{}
+	rcv := &firetap.Receiver{TraceContext: true}
+	h := rcv.Handler(sender)
+
+	// r1: the span of the invocation by platform.start
+	postTelemetry(t, h,
+		`{"time":"2024-06-15T00:00:00.000Z","type":"platform.start","record":{"requestId":"r1","version":"$LATEST","tracing":{"spanId":"24cd7d670fa455f0","type":"X-Amzn-Trace-Id","value":"Root=1-5e1b4151-5ac6c58f2a0c3d4d4c7e1b2f;Parent=53995c3f42cd8ad8;Sampled=1"}}}`,
+		`{"time":"2024-06-15T00:00:00.001Z","type":"function","record":"text log"}`,
+		`{"time":"2024-06-15T00:00:00.002Z","type":"function","record":{"level":"INFO","msg":"json log"}}`,
+		`{"time":"2024-06-15T00:00:00.003Z","type":"platform.runtimeDone","record":{"requestId":"r1","status":"success"}}`,
+	)
+	// r2: the parent in the header of the INVOKE event
+	ev := &firetap.ExtensionEvent{EventType: "INVOKE", RequestID: "r2"}
+	ev.Tracing.Type = "X-Amzn-Trace-Id"
+	ev.Tracing.Value = "Root=1-66666666-777777777777777777777777;Parent=8888888888888888;Sampled=1"
+	rcv.ObserveInvoke(ev)
+	postTelemetry(t, h,
+		`{"time":"2024-06-15T00:00:01.000Z","type":"platform.start","record":{"requestId":"r2","version":"$LATEST"}}`,
+		`{"time":"2024-06-15T00:00:01.001Z","type":"function","record":"r2 log"}`,
+		// a late log of r1 re-posted by the wrapper
+		`{"time":"2024-06-15T00:00:00.004Z","type":"function","record":"late r1 log","requestId":"r1"}`,
+		// r3: unknown
+		`{"time":"2024-06-15T00:00:02.000Z","type":"platform.start","record":{"requestId":"r3","version":"$LATEST"}}`,
+		`{"time":"2024-06-15T00:00:02.001Z","type":"function","record":"r3 log"}`,
+	)
+	want := []string{
+		`{"trace_id":"5e1b41515ac6c58f2a0c3d4d4c7e1b2f","span_id":"24cd7d670fa455f0","message":"text log"}`,
+		`{"trace_id":"5e1b41515ac6c58f2a0c3d4d4c7e1b2f","span_id":"24cd7d670fa455f0","level":"INFO","msg":"json log"}`,
+		`{"trace_id":"66666666777777777777777777777777","span_id":"8888888888888888","message":"r2 log"}`,
+		`{"trace_id":"5e1b41515ac6c58f2a0c3d4d4c7e1b2f","span_id":"24cd7d670fa455f0","message":"late r1 log"}`,
+		`r3 log`,
+	}
+	if got := strings.TrimSuffix(sender.String(), "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("unexpected records:\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestTraceContextExistingFields(t *testing.T) {
+	sender := &testLogSender{}
+	rcv := &firetap.Receiver{TraceContext: true, TagRecords: true}
+	h := rcv.Handler(sender)
+
+	postTelemetry(t, h,
+		`{"time":"2024-06-15T00:00:00.000Z","type":"platform.start","record":{"requestId":"r1","version":"$LATEST","tracing":{"spanId":"24cd7d670fa455f0","type":"X-Amzn-Trace-Id","value":"Root=1-5e1b4151-5ac6c58f2a0c3d4d4c7e1b2f;Parent=53995c3f42cd8ad8;Sampled=1"}}}`,
+		// the trace context of the application wins
+		`{"time":"2024-06-15T00:00:00.001Z","type":"function","record":{"trace_id":"app-trace","msg":"otel log"}}`,
+		`{"time":"2024-06-15T00:00:00.002Z","type":"function","record":{"span\u005fid":"app-span","msg":"escaped key"}}`,
+		// nested fields don't conflict
+		`{"time":"2024-06-15T00:00:00.003Z","type":"function","record":{"ctx":{"trace_id":"nested"}}}`,
+		// the tags of the wrapper
+		`{"time":"2024-06-15T00:00:00.004Z","type":"function","record":{"stream":"app","requestId":"app-req","trace_id":"x","span_id":"y"},"stream":"stderr","requestId":"r1"}`,
+		`{"time":"2024-06-15T00:00:00.005Z","type":"function","record":"text log","stream":"stdout","requestId":"r1"}`,
+	)
+	want := []string{
+		`{"span_id":"24cd7d670fa455f0","trace_id":"app-trace","msg":"otel log"}`,
+		`{"trace_id":"5e1b41515ac6c58f2a0c3d4d4c7e1b2f","span\u005fid":"app-span","msg":"escaped key"}`,
+		`{"trace_id":"5e1b41515ac6c58f2a0c3d4d4c7e1b2f","span_id":"24cd7d670fa455f0","ctx":{"trace_id":"nested"}}`,
+		`{"stream":"app","requestId":"app-req","trace_id":"x","span_id":"y"}`,
+		`{"trace_id":"5e1b41515ac6c58f2a0c3d4d4c7e1b2f","span_id":"24cd7d670fa455f0","stream":"stdout","requestId":"r1","message":"text log"}`,
+	}
+	if got := strings.TrimSuffix(sender.String(), "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("unexpected records:\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+	for _, line := range strings.Split(sender.String(), "\n") {
+		if line != "" && !json.Valid([]byte(line)) {
+			t.Errorf("invalid JSON: %s", line)
+		}
+	}
+}
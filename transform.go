@@ -0,0 +1,95 @@
+package firetap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/itchyny/gojq"
+)
+
+const defaultTransformTimeout = 100 * time.Millisecond
+
+// transform is a Processor that runs a jq expression against the record.
+//
+// The input is the JSON object of the record, or {"message": line} for a text record.
+// $time is the time of the record in RFC3339 with nanoseconds.
+// $ENV is empty not to leak the credentials in the environment variables into the records.
+// The first output replaces the record. When the expression outputs nothing, null or false,
+// the record is dropped. When the expression fails or times out, the record is passed as is.
+type transform struct {
+	code    *gojq.Code
+	timeout time.Duration
+}
+
+func newTransform(cfg ProcessorConfig) (*transform, error) {
+	code, err := compileTransform(cfg.Expr)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = defaultTransformTimeout
+	}
+	return &transform{code: code, timeout: timeout}, nil
+}
+
+func compileTransform(expr string) (*gojq.Code, error) {
+	if expr == "" {
+		return nil, fmt.Errorf("expr is required")
+	}
+	query, err := gojq.Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse jq expression: %w", err)
+	}
+	code, err := gojq.Compile(query, gojq.WithVariables([]string{"$time"}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile jq expression: %w", err)
+	}
+	return code, nil
+}
+
+func (t *transform) Process(ctx context.Context, rec Record) (Record, bool) {
+	line := bytes.TrimRight(rec.Data, "\r\n")
+	var input any = map[string]any{"message": string(line)}
+	if len(line) > 0 && line[0] == '{' {
+		var obj map[string]any
+		if err := json.Unmarshal(line, &obj); err == nil {
+			input = obj
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	v, ok := t.code.RunWithContext(ctx, input, rec.Time.Format(time.RFC3339Nano)).Next()
+	if !ok {
+		return rec, false
+	}
+	var b []byte
+	switch v := v.(type) {
+	case nil:
+		return rec, false
+	case bool:
+		if !v {
+			return rec, false
+		}
+		// true passes the record as is, like select
+		return rec, true
+	case error:
+		slog.WarnContext(ctx, "failed to run jq expression, passing the record", "error", v)
+		return rec, true
+	case string:
+		b = []byte(v)
+	default:
+		var err error
+		if b, err = gojq.Marshal(v); err != nil {
+			slog.WarnContext(ctx, "failed to marshal the jq output, passing the record", "error", err)
+			return rec, true
+		}
+	}
+	rec.Data = append(b, '\n')
+	return rec, true
+}
@@ -0,0 +1,128 @@
+package firetap_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/firetap"
+)
+
+var transformTests = []struct {
+	name string
+	expr string
+	line string
+	want string // empty means dropped
+}{
+	{
+		name: "add and rename fields",
+		expr: `.service = "api" | .msg = .message | del(.message)`,
+		line: `{"message":"hello","level":"info"}` + "\n",
+		want: `{"level":"info","msg":"hello","service":"api"}` + "\n",
+	},
+	{
+		name: "text record",
+		expr: `{text: .message}`,
+		line: "hello world\n",
+		want: `{"text":"hello world"}` + "\n",
+	},
+	{
+		name: "routing key",
+		expr: `.route = if .level == "ERROR" then "errors" else "logs" end`,
+		line: `{"level":"ERROR"}` + "\n",
+		want: `{"level":"ERROR","route":"errors"}` + "\n",
+	},
+	{
+		name: "drop by select",
+		expr: `select(.level != "DEBUG")`,
+		line: `{"level":"DEBUG"}` + "\n",
+	},
+	{
+		name: "drop by null",
+		expr: `null`,
+		line: "hello\n",
+	},
+	{
+		name: "string output",
+		expr: `.message | ascii_upcase`,
+		line: "hello\n",
+		want: "HELLO\n",
+	},
+	{
+		name: "environment variables are not exposed",
+		expr: `{secret: $ENV.AWS_SECRET_ACCESS_KEY, env: env.AWS_SECRET_ACCESS_KEY}`,
+		line: "hello\n",
+		want: `{"env":null,"secret":null}` + "\n",
+	},
+	{
+		name: "runtime error passes the record",
+		expr: `.message | tonumber`,
+		line: "hello\n",
+		want: "hello\n",
+	},
+}
+
+func TestTransformProcessor(t *testing.T) {
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	ctx := context.Background()
+	for _, tt := range transformTests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := firetap.NewProcessor(firetap.ProcessorConfig{Type: "jq", Expr: tt.expr})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec, ok := p.Process(ctx, firetap.Record{Data: []byte(tt.line)})
+			if tt.want == "" {
+				if ok {
+					t.Errorf("record must be dropped: %q", rec.Data)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("record is dropped")
+			}
+			if string(rec.Data) != tt.want {
+				t.Errorf("unexpected record: %q", rec.Data)
+			}
+		})
+	}
+}
+
+func TestTransformProcessorTimeout(t *testing.T) {
+	p, err := firetap.NewProcessor(firetap.ProcessorConfig{
+		Type:    "jq",
+		Expr:    `last(range(1e12))`,
+		Timeout: firetap.Duration(10 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	rec, ok := p.Process(context.Background(), firetap.Record{Data: []byte("hello\n")})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout is not applied: %s", elapsed)
+	}
+	if !ok || string(rec.Data) != "hello\n" {
+		t.Errorf("record must be passed as is: %q %v", rec.Data, ok)
+	}
+}
+
+func TestTransformProcessorInvalid(t *testing.T) {
+	for _, expr := range []string{"", ".foo |", "undefined_func(1)"} {
+		if _, err := firetap.NewProcessor(firetap.ProcessorConfig{Type: "jq", Expr: expr}); err == nil {
+			t.Errorf("error expected for %q", expr)
+		}
+	}
+}
+
+func TestTransformProcessorTime(t *testing.T) {
+	p, err := firetap.NewProcessor(firetap.ProcessorConfig{Type: "jq", Expr: `.time = $time`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2024, 6, 15, 0, 0, 0, 123456789, time.UTC)
+	rec, _ := p.Process(context.Background(), firetap.Record{Time: ts, Data: []byte(`{"a":1}` + "\n")})
+	if want := `{"a":1,"time":"2024-06-15T00:00:00.123456789Z"}` + "\n"; string(rec.Data) != want {
+		t.Errorf("unexpected record: %q", rec.Data)
+	}
+}
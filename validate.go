@@ -0,0 +1,46 @@
+package firetap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	slogcontext "github.com/PumpkinSeed/slog-context"
+)
+
+// Validate validates the configuration, checks the destinations (optional)
+// and runs the sample lines through the pipeline in the dry run mode.
+func Validate(ctx context.Context, opt *Option) error {
+	ctx = slogcontext.WithValue(ctx, "component", "validate")
+	return validate(ctx, opt, os.Stdout)
+}
+
+func validate(ctx context.Context, opt *Option, w io.Writer) error {
+	cfg, err := LoadConfig(opt)
+	if err != nil {
+		return err
+	}
+	rcv, err := NewReceiver(ctx, opt, cfg)
+	if err != nil {
+		return err
+	}
+	// compiles the processors, the filters and the stream name templates
+	pipeline, err := NewDryRunPipeline(ctx, cfg, w)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "configuration is valid", "processors", len(cfg.Processors), "outputs", pipeline.Destination())
+	if opt.Validate.Check {
+		if err := pipeline.Check(ctx); err != nil {
+			return err
+		}
+	}
+	for _, name := range opt.Validate.Samples {
+		if _, err := sendFile(ctx, rcv, pipeline, name, opt.Validate.Format); err != nil {
+			return fmt.Errorf("failed to run %s: %w", name, err)
+		}
+	}
+	return pipeline.Flush(ctx)
+}
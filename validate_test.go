@@ -0,0 +1,103 @@
+package firetap_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fujiwara/firetap"
+)
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidate(t *testing.T) {
+	config := writeTestFile(t, "firetap.yaml", `
+processors:
+  - type: parse
+    format: logfmt
+outputs:
+  - name: tenants
+    stream_name: "logs-{{.tenant}}"
+    fallback_stream: logs-default
+  - name: errors
+    type: kinesis
+    stream_name: errors
+    filter:
+      include: error
+`)
+	samples := writeTestFile(t, "samples.txt", "tenant=a msg=hello\nlevel=error msg=boom\n")
+	var out strings.Builder
+	err := firetap.ValidateTo(&firetap.Option{
+		Config:   config,
+		Validate: firetap.ValidateOption{Samples: []string{samples}, Format: "auto"},
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := map[string]bool{
+		"tenants\tlogs-a\t" + `{"msg":"hello","tenant":"a"}`:         true,
+		"tenants\tlogs-default\t" + `{"level":"error","msg":"boom"}`: true,
+		"errors\terrors\t" + `{"level":"error","msg":"boom"}`:        true,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+	for _, l := range lines {
+		if !expected[l] {
+			t.Errorf("unexpected line: %q", l)
+		}
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	config := writeTestFile(t, "firetap.yaml", `
+processors:
+  - type: jq
+    expr: ".foo |"
+outputs:
+  - stream_name: test
+`)
+	if err := firetap.ValidateTo(&firetap.Option{Config: config}, &strings.Builder{}); err == nil {
+		t.Error("error expected")
+	}
+}
+
+func TestValidateCheck(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "dummy")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "dummy")
+	t.Setenv("AWS_REGION", "us-east-1")
+	status := "ACTIVE"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "Firehose_20150804.DescribeDeliveryStream" {
+			http.Error(w, "unexpected", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"DeliveryStreamDescription":{"DeliveryStreamName":"test","DeliveryStreamStatus":"` + status + `"}}`))
+	}))
+	defer s.Close()
+	config := writeTestFile(t, "firetap.yaml", `
+outputs:
+  - stream_name: test
+    endpoint: `+s.URL+`
+`)
+	opt := &firetap.Option{Config: config, Validate: firetap.ValidateOption{Check: true}}
+	if err := firetap.ValidateTo(opt, &strings.Builder{}); err != nil {
+		t.Fatal(err)
+	}
+	status = "CREATING"
+	if err := firetap.ValidateTo(opt, &strings.Builder{}); err == nil || !strings.Contains(err.Error(), "CREATING") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
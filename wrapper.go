@@ -1,7 +1,6 @@
 package firetap
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -14,6 +13,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -23,7 +23,7 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func Wrapper(ctx context.Context, handler string) error {
+func Wrapper(ctx context.Context, handler string, opt *Option) error {
 	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, unix.SIGINT)
 	defer stop()
 
@@ -33,12 +33,25 @@ func Wrapper(ctx context.Context, handler string) error {
 	if !filepath.IsAbs(handler) {
 		handler = filepath.Join(os.Getenv("LAMBDA_TASK_ROOT"), handler)
 	}
+	cfg, err := LoadConfig(opt)
+	if err != nil {
+		return err
+	}
 	slog.InfoContext(ctx, "running child command", "command", handler)
 
 	c := NewTelemetryAPIClient(fmt.Sprintf("http://127.0.0.1:%d", listenPort))
+	c.SetBudget(TelemetryBudget{
+		MaxEvents: cfg.Wrapper.Buffer.MaxEvents,
+		MaxBytes:  cfg.Wrapper.Buffer.MaxBytes,
+		Policy:    cfg.Wrapper.Buffer.DropPolicy,
+	})
+	var passthrough io.Writer
+	if cfg.Wrapper.StderrPassthrough {
+		passthrough = os.Stderr
+	}
 	cmd := exec.CommandContext(ctx, handler)
 	cmd.Stdout = c
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = c.Stderr(passthrough)
 	cmd.Stdin = os.Stdin
 	cmd.Cancel = func() error {
 		slog.InfoContext(ctx, "sending SIGTERM to child command")
@@ -49,6 +62,20 @@ func Wrapper(ctx context.Context, handler string) error {
 	cmd.Env = append(cmd.Env, antiRecursionEnv+"=1")
 
 	var wg sync.WaitGroup
+	if cfg.Wrapper.RuntimeProxy {
+		proxy, err := NewRuntimeAPIProxy(os.Getenv("AWS_LAMBDA_RUNTIME_API"), c)
+		if err != nil {
+			return fmt.Errorf("failed to start runtime API proxy: %w", err)
+		}
+		cmd.Env = append(cmd.Env, "AWS_LAMBDA_RUNTIME_API="+proxy.Addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := proxy.Run(ctx); err != nil {
+				slog.ErrorContext(ctx, "failed to run runtime API proxy", "error", err)
+			}
+		}()
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -56,7 +83,7 @@ func Wrapper(ctx context.Context, handler string) error {
 		c.Run(ctx)
 	}()
 
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		exitCode := wrapcommander.ResolveExitCode(err)
 		slog.ErrorContext(ctx, "child command failed", "error", err, "exit_code", exitCode)
@@ -65,84 +92,235 @@ func Wrapper(ctx context.Context, handler string) error {
 	return err
 }
 
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+)
+
+const (
+	DropPolicyBlock      = "block"
+	DropPolicyDropOldest = "drop_oldest"
+	DropPolicyDropNewest = "drop_newest"
+
+	defaultBudgetEvents = 10000
+	defaultBudgetBytes  = 16 * 1024 * 1024
+	maxLineBytes        = 256 * 1024
+)
+
+// TelemetryBudget bounds the events buffered in TelemetryAPIClient while they are not posted.
+type TelemetryBudget struct {
+	MaxEvents int
+	MaxBytes  int
+	// Policy is the behavior on exceeding the budget (block, drop_oldest or drop_newest).
+	// block blocks the writes of the child command until the events are posted.
+	Policy string
+}
+
 // TelemetryAPIClient is a client for sending telemetry data to the Firetap service.
-// It implements the io.Writer interface.
+// It implements the io.Writer interface for the stdout of the child command.
 type TelemetryAPIClient struct {
-	w        io.Writer
-	r        *bufio.Reader
+	stdout   *streamWriter
 	events   []TelemetryPostEvent
+	size     int // bytes of the records in events
 	endpoint string
 	client   *http.Client
 	mu       *sync.Mutex
+	cond     *sync.Cond // signaled when the events are posted
+	closed   bool
+	writers  []*streamWriter
+	current  Invocation
+	flushCh  chan chan struct{}
+
+	budget  TelemetryBudget
+	dropped atomic.Int64
 }
 
 func NewTelemetryAPIClient(endpoint string) *TelemetryAPIClient {
 	client := &http.Client{
 		Timeout: 1000 * time.Millisecond, // TODO: use TimeoutMS
 	}
-	r, w := io.Pipe()
-	return &TelemetryAPIClient{
-		w:        w,
-		r:        bufio.NewReader(r),
+	c := &TelemetryAPIClient{
 		events:   make([]TelemetryPostEvent, 0, 500),
 		endpoint: endpoint,
 		client:   client,
 		mu:       new(sync.Mutex),
+		flushCh:  make(chan chan struct{}),
+		budget: TelemetryBudget{
+			MaxEvents: defaultBudgetEvents,
+			MaxBytes:  defaultBudgetBytes,
+			Policy:    DropPolicyDropOldest,
+		},
 	}
+	c.cond = sync.NewCond(c.mu)
+	c.stdout = c.newStreamWriter(streamStdout, nil)
+	return c
+}
+
+// SetBudget sets the budget of the buffered events. It must be called before writing.
+func (c *TelemetryAPIClient) SetBudget(b TelemetryBudget) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.budget = b
+}
+
+// Dropped returns the number of the lines dropped by the budget.
+func (c *TelemetryAPIClient) Dropped() int64 {
+	return c.dropped.Load()
 }
 
 func (c *TelemetryAPIClient) Write(p []byte) (n int, err error) {
 	slog.DebugContext(context.Background(), "writing", "bytes", len(p))
-	return c.w.Write(p)
+	return c.stdout.Write(p)
 }
 
-func (c *TelemetryAPIClient) readEvents(ctx context.Context) {
-	ctx = slogcontext.WithValue(ctx, "component", "event-reader")
-	for {
-		line, err := c.r.ReadString('\n')
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			slog.ErrorContext(ctx, "failed to read line", "error", err)
-			break
+// Stderr returns an io.Writer for the stderr of the child command.
+// Lines written to it are tagged with the "stderr" stream.
+// If passthrough is not nil, the written bytes are also copied to it.
+func (c *TelemetryAPIClient) Stderr(passthrough io.Writer) io.Writer {
+	return c.newStreamWriter(streamStderr, passthrough)
+}
+
+func (c *TelemetryAPIClient) newStreamWriter(stream string, passthrough io.Writer) *streamWriter {
+	w := &streamWriter{
+		client:      c,
+		stream:      stream,
+		passthrough: passthrough,
+	}
+	c.mu.Lock()
+	c.writers = append(c.writers, w)
+	c.mu.Unlock()
+	return w
+}
+
+// appendEvent appends a line as a function event.
+// Events are stamped when the line is completed, so the order between streams is preserved
+// as well as the child command writes them.
+//
+// When the events exceed the budget, the line is handled by the policy of the budget.
+func (c *TelemetryAPIClient) appendEvent(stream string, line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.exceeds(len(line)) {
+		if len(c.events) == 0 {
+			// the line itself exceeds the budget
+			c.dropped.Add(1)
+			return
+		}
+		switch {
+		case c.budget.Policy == DropPolicyBlock && !c.closed:
+			c.cond.Wait()
+			continue
+		case c.budget.Policy == DropPolicyDropOldest:
+			c.size -= len(c.events[0].Record)
+			c.events[0] = TelemetryPostEvent{}
+			c.events = c.events[1:]
+			c.dropped.Add(1)
+			continue
 		}
-		c.mu.Lock()
-		c.events = append(c.events, TelemetryPostEvent{
-			Time:   time.Now().Format(time.RFC3339),
-			Type:   "function",
-			Record: line,
-		})
-		c.mu.Unlock()
+		// drop_newest, or block after closed
+		c.dropped.Add(1)
+		return
+	}
+	c.size += len(line)
+	now := time.Now()
+	c.events = append(c.events, TelemetryPostEvent{
+		Time:      now.Format(time.RFC3339Nano),
+		Type:      "function",
+		Record:    line,
+		Stream:    stream,
+		RequestID: c.current.RequestID,
+		ID:        newRecordID(now),
+		Seq:       recordSeq.Add(1),
+	})
+}
+
+func (c *TelemetryAPIClient) exceeds(size int) bool {
+	return len(c.events)+1 > c.budget.MaxEvents || c.size+size > c.budget.MaxBytes
+}
+
+// StartInvocation sets the current invocation. The following lines are tagged with its request ID.
+func (c *TelemetryAPIClient) StartInvocation(inv Invocation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = inv
+}
+
+// EndInvocation flushes the lines of the current invocation and waits for them to be posted.
+func (c *TelemetryAPIClient) EndInvocation(ctx context.Context) {
+	c.flushWriters()
+	done := make(chan struct{})
+	select {
+	case c.flushCh <- done:
+		// wait for the Run loop to post the events
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = Invocation{}
+}
+
+// flushWriters appends the incomplete lines remaining in the stream writers.
+func (c *TelemetryAPIClient) flushWriters() {
+	c.mu.Lock()
+	writers := c.writers
+	c.mu.Unlock()
+	for _, w := range writers {
+		w.flush()
 	}
 }
 
 func (c *TelemetryAPIClient) Run(ctx context.Context) {
 	defer slog.InfoContext(ctx, "telemetry client stopped")
-	go c.readEvents(ctx)
 
 	ctx = slogcontext.WithValue(ctx, "component", "telemetry-client")
 	ticker := time.NewTicker(1000 * time.Millisecond) // TODO: use IntervalMS
 	defer ticker.Stop()
+	var reported int64
 	for {
 		final := false
+		var done chan struct{}
 		select {
 		case <-ticker.C:
+		case done = <-c.flushCh:
 		case <-ctx.Done():
 			slog.InfoContext(ctx, "shutting down telemetry client")
 			ctx = slogcontext.WithValue(context.Background(), "component", "telemetry-client")
 			final = true
+			c.close()
+			c.flushWriters()
+		}
+		if n := c.Dropped(); n > reported {
+			slog.WarnContext(ctx, "lines are dropped by the buffer budget", "dropped", n-reported, "total", n, "policy", c.budget.Policy)
+			reported = n
 		}
 		if sent, err := c.Post(ctx); err != nil {
 			slog.ErrorContext(ctx, "failed to send telemetry", "error", err)
 		} else {
 			slog.DebugContext(ctx, "telemetry sent", "events", sent)
 		}
+		if done != nil {
+			close(done)
+		}
 		if final {
 			break
 		}
 	}
 }
 
+// close releases the writers blocked by the budget. After that, the block policy drops the newest lines.
+func (c *TelemetryAPIClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+}
+
+// Post sends the buffered events in chunks. The events of the chunks sent successfully
+// are removed from the buffer even if a later chunk fails, so they are not sent twice.
 func (c *TelemetryAPIClient) Post(ctx context.Context) (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -151,10 +329,13 @@ func (c *TelemetryAPIClient) Post(ctx context.Context) (int, error) {
 		return 0, nil
 	}
 	sent := 0
+	defer func() {
+		c.removeEvents(sent)
+	}()
+	buf := new(bytes.Buffer)
 	for _, events := range lo.Chunk(c.events, 500) {
 		slog.DebugContext(ctx, "sending telemetry", "events", len(events))
-		buf := bufPool.Get().(*bytes.Buffer)
-		defer bufPool.Put(buf)
+		buf.Reset()
 		if err := json.NewEncoder(buf).Encode(events); err != nil {
 			return sent, err
 		}
@@ -164,18 +345,84 @@ func (c *TelemetryAPIClient) Post(ctx context.Context) (int, error) {
 		if err != nil {
 			return sent, err
 		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
 		if resp.StatusCode != http.StatusOK {
 			return sent, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 		}
 		slog.InfoContext(ctx, "telemetry sent", "bytes", size)
 		sent += len(events)
 	}
-	c.events = c.events[:0]
 	return sent, nil
 }
 
+// removeEvents removes the first n events and wakes up the writers blocked by the budget.
+func (c *TelemetryAPIClient) removeEvents(n int) {
+	if n == 0 {
+		return
+	}
+	for _, ev := range c.events[:n] {
+		c.size -= len(ev.Record)
+	}
+	rest := copy(c.events, c.events[n:])
+	clear(c.events[rest:])
+	c.events = c.events[:rest]
+	c.cond.Broadcast()
+}
+
 type TelemetryPostEvent struct {
-	Time   string `json:"time"`
-	Type   string `json:"type"`
-	Record string `json:"record"`
+	Time      string `json:"time"`
+	Type      string `json:"type"`
+	Record    string `json:"record"`
+	Stream    string `json:"stream,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	ID        string `json:"id,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"`
+}
+
+// streamWriter splits the output of the child command into lines.
+type streamWriter struct {
+	client      *TelemetryAPIClient
+	stream      string
+	passthrough io.Writer
+	buf         []byte
+	mu          sync.Mutex
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.passthrough != nil {
+		if _, err := w.passthrough.Write(p); err != nil {
+			slog.Debug("failed to pass through", "stream", w.stream, "error", err)
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			if len(w.buf) >= maxLineBytes {
+				// split a too long line not to buffer it unboundedly
+				w.client.appendEvent(w.stream, string(w.buf[:maxLineBytes])+"\n")
+				w.buf = w.buf[maxLineBytes:]
+				continue
+			}
+			break
+		}
+		w.client.appendEvent(w.stream, string(w.buf[:i+1]))
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) == 0 {
+		w.buf = nil
+	}
+	return len(p), nil
+}
+
+func (w *streamWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.client.appendEvent(w.stream, string(w.buf)+"\n")
+		w.buf = nil
+	}
 }
@@ -0,0 +1,133 @@
+package firetap_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/firetap"
+)
+
+// newFlakyTelemetryServer returns a receiver that fails while down is true.
+func newFlakyTelemetryServer(t *testing.T, sender firetap.Sender, down *atomic.Bool) *httptest.Server {
+	t.Helper()
+	h := firetap.HandleTelemetry(sender, false)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestTelemetryAPIBudget(t *testing.T) {
+	for _, tc := range []struct {
+		policy  string
+		want    string
+		dropped int64
+	}{
+		{policy: firetap.DropPolicyDropNewest, want: stdoutLines("0", "1", "2"), dropped: 2},
+		{policy: firetap.DropPolicyDropOldest, want: stdoutLines("2", "3", "4"), dropped: 2},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			ctx := context.Background()
+			sender := &testLogSender{}
+			var down atomic.Bool
+			down.Store(true)
+			s := newFlakyTelemetryServer(t, sender, &down)
+			c := firetap.NewTelemetryAPIClient(s.URL)
+			c.SetBudget(firetap.TelemetryBudget{MaxEvents: 3, MaxBytes: 1024, Policy: tc.policy})
+			for i := range 5 {
+				fmt.Fprintf(c, "%d\n", i)
+			}
+			if _, err := c.Post(ctx); err == nil {
+				t.Fatal("post must fail")
+			}
+			down.Store(false)
+			if _, err := c.Post(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if sender.String() != tc.want {
+				t.Errorf("unexpected logs: %q", sender.String())
+			}
+			if c.Dropped() != tc.dropped {
+				t.Errorf("dropped = %d, want %d", c.Dropped(), tc.dropped)
+			}
+		})
+	}
+}
+
+func TestTelemetryAPIBudgetBlock(t *testing.T) {
+	ctx := context.Background()
+	sender := &testLogSender{}
+	var down atomic.Bool
+	s := newFlakyTelemetryServer(t, sender, &down)
+	c := firetap.NewTelemetryAPIClient(s.URL)
+	c.SetBudget(firetap.TelemetryBudget{MaxEvents: 2, MaxBytes: 1024, Policy: firetap.DropPolicyBlock})
+	c.Write([]byte("foo\nbar\n"))
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		c.Write([]byte("baz\n"))
+	}()
+	select {
+	case <-written:
+		t.Fatal("write must be blocked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := c.Post(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("write must be released by the post")
+	}
+	if _, err := c.Post(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sender.String() != stdoutLines("foo", "bar", "baz") || c.Dropped() != 0 {
+		t.Errorf("unexpected logs: %q dropped=%d", sender.String(), c.Dropped())
+	}
+}
+
+func TestTelemetryAPIPostPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	sender := &testLogSender{}
+	var requests atomic.Int64
+	h := firetap.HandleTelemetry(sender, false)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 2 {
+			// the second chunk fails
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r)
+	}))
+	defer s.Close()
+
+	c := firetap.NewTelemetryAPIClient(s.URL)
+	var expected strings.Builder
+	for i := range 600 {
+		fmt.Fprintf(c, "%d\n", i)
+		expected.WriteString(stdoutLines(fmt.Sprint(i)))
+	}
+	if sent, err := c.Post(ctx); err == nil || sent != 500 {
+		t.Fatalf("Post() = (%d, %v), want (500, error)", sent, err)
+	}
+	if sent, err := c.Post(ctx); err != nil || sent != 100 {
+		t.Fatalf("Post() = (%d, %v), want (100, nil)", sent, err)
+	}
+	if sender.String() != expected.String() {
+		t.Error("the sent chunk must not be sent twice")
+	}
+}